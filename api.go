@@ -0,0 +1,460 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/history"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//apiHandler serves the JSON API below /api/v1/ from the most recent report of
+//the given collector, and from the history store (if enabled). Apart from
+//the collection trigger (if enabled), the API is read-only.
+type apiHandler struct {
+	collector            *entanglementCollector
+	history              *history.Store
+	recommendationTarget uint64
+	//receives a value when POST /api/v1/collect is called
+	collectTrigger      chan<- struct{}
+	collectTriggerToken string
+}
+
+type apiProjectSummary struct {
+	ID                 string `json:"id"`
+	MaxScore           uint64 `json:"max_score"`
+	TotalScore         uint64 `json:"total_score"`
+	PartitionCount     int    `json:"partition_count"`
+	SecurityGroupCount int    `json:"security_group_count"`
+}
+
+type apiProject struct {
+	apiProjectSummary
+	ScoreByFactorKind map[core.FactorKind]uint64 `json:"score_by_factor"`
+	//key = foreign project UUID
+	ForeignScores map[string]uint64 `json:"foreign_score_by_project"`
+	Partitions    []apiPartition    `json:"partitions"`
+}
+
+type apiPartition struct {
+	ID              string                `json:"id"`
+	Score           core.Score            `json:"score"`
+	SecurityGroups  []*core.SecurityGroup `json:"security_groups"`
+	Recommendations []core.Recommendation `json:"recommendations,omitempty"`
+	//Only set together with Recommendations (see renderPartitionWithRecommendations).
+	ScoreAfterRecommendations *uint64 `json:"score_after_recommendations,omitempty"`
+	TargetReached             *bool   `json:"target_reached,omitempty"`
+}
+
+type apiTopPartition struct {
+	ProjectID string `json:"project_id"`
+	apiPartition
+}
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+
+	//simulations do not change anything, but need a request body
+	isSimulation := len(path) == 3 && path[0] == "projects" && path[2] == "simulate"
+	isCollectTrigger := len(path) == 1 && path[0] == "collect"
+	isPost := isSimulation || isCollectTrigger
+	if isPost && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isPost && r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//collections can also be triggered before the first collection has completed
+	if isCollectTrigger {
+		h.triggerCollection(w, r)
+		return
+	}
+
+	//the history is also available before the first collection has completed
+	if len(path) >= 3 && path[0] == "projects" && path[2] == "history" {
+		switch {
+		case len(path) == 3:
+			h.showHistory(w, r, path[1])
+		case len(path) == 4 && path[3] == "changes":
+			h.showHistoryChanges(w, r, path[1])
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	report := h.collector.Report()
+	if report == nil {
+		http.Error(w, "no data collected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "projects":
+		h.listProjects(w, r, report)
+	case len(path) == 2 && path[0] == "projects":
+		h.showProject(w, r, report, path[1])
+	case isSimulation:
+		h.simulate(w, r, report, path[1])
+	case len(path) == 3 && path[0] == "projects" && path[2] == "recommendations":
+		h.showRecommendations(w, r, report, path[1])
+	case len(path) == 3 && path[0] == "projects" && path[2] == "graph":
+		h.showProjectGraph(w, r, report, path[1])
+	case len(path) == 1 && path[0] == "top":
+		h.listTopPartitions(w, r, report)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h apiHandler) triggerCollection(w http.ResponseWriter, r *http.Request) {
+	if h.collectTriggerToken == "" || h.collectTrigger == nil {
+		http.Error(w, "collection trigger is not enabled", http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.collectTriggerToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	select {
+	case h.collectTrigger <- struct{}{}:
+	default:
+		//a triggered collection is already pending
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h apiHandler) listProjects(w http.ResponseWriter, r *http.Request, report *core.Report) {
+	projects := make([]apiProjectSummary, 0, len(report.Projects))
+	for _, pr := range report.Projects {
+		projects = append(projects, renderProjectSummary(pr))
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].ID < projects[j].ID
+	})
+
+	respondWithJSON(w, report, "projects", projects)
+}
+
+func (h apiHandler) showProject(w http.ResponseWriter, r *http.Request, report *core.Report, projectID string) {
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	respondWithJSON(w, report, "project", renderProject(pr))
+}
+
+func (h apiHandler) showRecommendations(w http.ResponseWriter, r *http.Request, report *core.Report, projectID string) {
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	target := h.recommendationTarget
+	if str := r.URL.Query().Get("target"); str != "" {
+		var err error
+		target, err = strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid value for target", http.StatusBadRequest)
+			return
+		}
+	}
+
+	partitions := []apiPartition{}
+	for _, part := range pr.Partitions {
+		if part.Score.Value > target {
+			partitions = append(partitions, renderPartitionWithRecommendations(part, target))
+		}
+	}
+	sortPartitions(partitions)
+
+	respondWithJSON(w, report, "partitions", partitions)
+}
+
+//Upper bound for the size of request bodies for POST /api/v1/projects/:id/simulate.
+const maxSimulationRequestSize = 1 << 20
+
+func (h apiHandler) simulate(w http.ResponseWriter, r *http.Request, report *core.Report, projectID string) {
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Mutations []core.Mutation `json:"mutations"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSimulationRequestSize)).Decode(&req)
+	var tooLargeErr *http.MaxBytesError
+	if errors.As(err, &tooLargeErr) {
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := core.Simulate(pr.Project, req.Mutations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	respondWithJSON(w, report, "simulation", renderSimulation(result))
+}
+
+func (h apiHandler) showProjectGraph(w http.ResponseWriter, r *http.Request, report *core.Report, projectID string) {
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	partitions := selectGraphPartitions(pr, query.Get("partition"), query.Get("all") == "1")
+	var buf bytes.Buffer
+	err := core.WriteDOT(&buf, projectID, partitions)
+	if err != nil {
+		util.LogError("cannot render graph: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (h apiHandler) listTopPartitions(w http.ResponseWriter, r *http.Request, report *core.Report) {
+	n := 20
+	if str := r.URL.Query().Get("n"); str != "" {
+		var err error
+		n, err = strconv.Atoi(str)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid value for n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var partitions []apiTopPartition
+	for projectID, pr := range report.Projects {
+		for _, part := range pr.Partitions {
+			if part.Score.Value > 0 {
+				partitions = append(partitions, apiTopPartition{projectID, renderPartition(part)})
+			}
+		}
+	}
+	sortTopPartitions(partitions)
+	if len(partitions) > n {
+		partitions = partitions[:n]
+	}
+	if partitions == nil {
+		partitions = []apiTopPartition{}
+	}
+
+	respondWithJSON(w, report, "partitions", partitions)
+}
+
+func (h apiHandler) showHistory(w http.ResponseWriter, r *http.Request, projectID string) {
+	if h.history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	from, to, ok := parseTimeRange(w, r, time.Time{})
+	if !ok {
+		return
+	}
+
+	records, err := h.history.ScoreHistory(projectID, from, to)
+	if err != nil {
+		util.LogError("cannot read history: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	respondWithJSON(w, nil, "history", records)
+}
+
+func (h apiHandler) showHistoryChanges(w http.ResponseWriter, r *http.Request, projectID string) {
+	if h.history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	from, to, ok := parseTimeRange(w, r, time.Now().Add(-24*time.Hour))
+	if !ok {
+		return
+	}
+
+	changes, err := h.history.Changes(projectID, from, to)
+	if err != nil {
+		util.LogError("cannot read history: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		http.NotFound(w, r)
+		return
+	}
+	respondWithJSON(w, nil, "changes", changes)
+}
+
+//Parses the "from" and "to" query parameters (RFC3339 timestamps). If not
+//given, "from" defaults to the given value, and "to" defaults to now. If the
+//parameters are invalid, an error response is written and false is returned.
+func parseTimeRange(w http.ResponseWriter, r *http.Request, defaultFrom time.Time) (from, to time.Time, ok bool) {
+	query := r.URL.Query()
+	from, to = defaultFrom, time.Now()
+	for _, param := range []struct {
+		Name   string
+		Target *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		str := query.Get(param.Name)
+		if str == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			http.Error(w, "invalid value for "+param.Name, http.StatusBadRequest)
+			return from, to, false
+		}
+		*param.Target = t
+	}
+	if to.Before(from) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return from, to, false
+	}
+	return from, to, true
+}
+
+type apiSimulation struct {
+	Before apiProject `json:"before"`
+	After  apiProject `json:"after"`
+}
+
+func renderSimulation(result *core.SimulationResult) apiSimulation {
+	return apiSimulation{
+		Before: renderProject(result.Before),
+		After:  renderProject(result.After),
+	}
+}
+
+func renderProject(pr *core.ProjectReport) apiProject {
+	project := apiProject{
+		apiProjectSummary: renderProjectSummary(pr),
+		ScoreByFactorKind: pr.TotalScoreByFactorKind,
+		ForeignScores:     pr.ForeignScores,
+		Partitions:        make([]apiPartition, 0, len(pr.Partitions)),
+	}
+	for _, part := range pr.Partitions {
+		project.Partitions = append(project.Partitions, renderPartition(part))
+	}
+	sortPartitions(project.Partitions)
+	return project
+}
+
+func renderProjectSummary(pr *core.ProjectReport) apiProjectSummary {
+	return apiProjectSummary{
+		ID:                 pr.Project.UUID,
+		MaxScore:           pr.MaxScore,
+		TotalScore:         pr.TotalScore,
+		PartitionCount:     len(pr.Partitions),
+		SecurityGroupCount: len(pr.Project.Groups),
+	}
+}
+
+func renderPartition(part core.PartitionReport) apiPartition {
+	result := apiPartition{
+		ID:             part.Partition.ID(),
+		Score:          part.Score,
+		SecurityGroups: make([]*core.SecurityGroup, 0, len(part.Partition)),
+	}
+	for _, groupID := range part.Partition.SortedGroupIDs() {
+		result.SecurityGroups = append(result.SecurityGroups, part.Partition[groupID])
+	}
+
+	//do not modify the shared report when sorting the factors
+	result.Score.Factors = append([]core.Factor{}, part.Score.Factors...)
+	sort.SliceStable(result.Score.Factors, func(i, j int) bool {
+		return result.Score.Factors[i].Value > result.Score.Factors[j].Value
+	})
+	return result
+}
+
+func renderPartitionWithRecommendations(part core.PartitionReport, target uint64) apiPartition {
+	result := renderPartition(part)
+	recommendations, remainingScore := part.Partition.Recommend(target)
+	targetReached := remainingScore <= target
+	result.Recommendations = recommendations
+	result.ScoreAfterRecommendations = &remainingScore
+	result.TargetReached = &targetReached
+	return result
+}
+
+//Sorts partitions descending by score.
+func sortTopPartitions(partitions []apiTopPartition) {
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Score.Value != partitions[j].Score.Value {
+			return partitions[i].Score.Value > partitions[j].Score.Value
+		}
+		return partitions[i].ID < partitions[j].ID
+	})
+}
+
+//Sorts partitions descending by score.
+func sortPartitions(partitions []apiPartition) {
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Score.Value != partitions[j].Score.Value {
+			return partitions[i].Score.Value > partitions[j].Score.Value
+		}
+		return partitions[i].ID < partitions[j].ID
+	})
+}
+
+//If report is nil, the "collected_at" key is omitted.
+func respondWithJSON(w http.ResponseWriter, report *core.Report, key string, data interface{}) {
+	envelope := map[string]interface{}{key: data}
+	if report != nil {
+		envelope["collected_at"] = report.CollectedAt.UTC().Format(time.RFC3339)
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		util.LogError("cannot serialize API response: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
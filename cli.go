@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Subcommands are one-off operations that run a single collection and print
+//their result on stdout, instead of running the exporter.
+var commands = map[string]func(args []string){
+	"diff":     commandDiff,
+	"dump":     commandDump,
+	"graph":    commandGraph,
+	"report":   commandReport,
+	"simulate": commandSimulate,
+}
+
+func runCommand(name string, args []string) {
+	command, exists := commands[name]
+	if !exists {
+		util.LogFatal("unknown subcommand: %s", name)
+	}
+
+	//keep stdout clean for the command's output
+	log.SetOutput(os.Stderr)
+	command(args)
+}
+
+//Parses the flags of a subcommand (including the --snapshot flag that is
+//shared by all subcommands) and reads the configuration.
+func parseCommandFlags(fs *flag.FlagSet, args []string) core.Config {
+	snapshotPath := fs.String("snapshot", "", "read data from this snapshot file instead of the configured data source")
+	fs.Parse(args)
+
+	cfg := core.ReadConfigFromEnvWithSnapshot(*snapshotPath)
+	core.UseScorer(cfg.Scorer)
+	setupDataSource(cfg)
+	return cfg
+}
+
+//Runs a single collection for a subcommand.
+func collectReportOnce(cfg core.Config) *core.Report {
+	startedAt := time.Now()
+	projects, err := collectData(cfg)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+	return core.NewReport(projects, startedAt)
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) (result bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			result = true
+		}
+	})
+	return result
+}
@@ -0,0 +1,124 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Usage: diff [--format table|json] [--project ID] OLD_SNAPSHOT NEW_SNAPSHOT
+//
+//Compares two snapshot files written by the dump subcommand, and prints for
+//each project that changed in between how it changed, and how much each
+//change contributed to the difference in score. Unlike the other
+//subcommands, this does not read any environment variables except for
+//SCORING_CONFIG.
+func commandDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", "table", "output format (table or json)")
+	projectID := fs.String("project", "", "only compare the project with this ID")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		util.LogFatal("usage: diff [--format table|json] [--project ID] OLD_SNAPSHOT NEW_SNAPSHOT")
+	}
+	if *format != "table" && *format != "json" {
+		util.LogFatal("unknown output format: %s", *format)
+	}
+
+	core.UseScorer(core.ReadScorerFromEnv())
+
+	var snapshots [2]*core.Snapshot
+	for idx := range snapshots {
+		var err error
+		snapshots[idx], err = core.ReadSnapshotFile(fs.Arg(idx))
+		if err != nil {
+			util.LogFatal(err.Error())
+		}
+	}
+	diffs := diffSnapshots(snapshots[0], snapshots[1], *projectID)
+
+	var err error
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diffs)
+	} else {
+		err = printDiffTable(diffs)
+	}
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+}
+
+//Computes the diffs of all projects (or only of the given project, if
+//projectID is not empty) that changed between the two snapshots, sorted
+//descending by growth of the maximum score.
+func diffSnapshots(before, after *core.Snapshot, projectID string) []core.ProjectDiff {
+	projectIDs := make(map[string]bool)
+	for id := range before.Projects {
+		projectIDs[id] = true
+	}
+	for id := range after.Projects {
+		projectIDs[id] = true
+	}
+
+	diffs := []core.ProjectDiff{}
+	for id := range projectIDs {
+		if projectID != "" && id != projectID {
+			continue
+		}
+		diff := core.Diff(before.Projects[id], after.Projects[id])
+		if len(diff.Changes) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		di := int64(diffs[i].MaxScoreAfter) - int64(diffs[i].MaxScoreBefore)
+		dj := int64(diffs[j].MaxScoreAfter) - int64(diffs[j].MaxScoreBefore)
+		if di != dj {
+			return di > dj
+		}
+		return diffs[i].ProjectID < diffs[j].ProjectID
+	})
+	return diffs
+}
+
+func printDiffTable(diffs []core.ProjectDiff) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tMAX SCORE\tTOTAL SCORE\tCHANGE")
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "%s\t%d -> %d\t%d -> %d\t\n",
+			diff.ProjectID, diff.MaxScoreBefore, diff.MaxScoreAfter, diff.TotalScoreBefore, diff.TotalScoreAfter,
+		)
+		for _, c := range diff.SortedChanges() {
+			fmt.Fprintf(w, "\t%+d\t%+d\t%s\n", c.MaxScoreDelta, c.TotalScoreDelta, c.Description)
+		}
+	}
+	return w.Flush()
+}
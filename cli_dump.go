@@ -0,0 +1,50 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Usage: dump OUTPUT_FILE
+//
+//Writes a snapshot of the collected data into the given file (gzip-compressed
+//if the file name ends in ".gz", or to stdout if the file name is "-").
+func commandDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	cfg := parseCommandFlags(fs, args)
+	if fs.NArg() != 1 {
+		util.LogFatal("usage: dump OUTPUT_FILE")
+	}
+
+	startedAt := time.Now()
+	projects, err := collectData(cfg)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+	err = core.WriteSnapshotFile(fs.Arg(0), core.NewSnapshot(projects, startedAt))
+	if err != nil {
+		util.LogFatal("cannot write snapshot: " + err.Error())
+	}
+}
@@ -0,0 +1,82 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"sort"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Usage: graph [--all] [--partition ID] PROJECT_ID
+//
+//Prints the entanglement graph of the given project in the Graphviz DOT
+//format. Pipe into `dot -Tsvg` to render it.
+func commandGraph(args []string) {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	all := fs.Bool("all", false, "include partitions with an entanglement score of 0")
+	partitionID := fs.String("partition", "", "only render the partition with this ID")
+	cfg := parseCommandFlags(fs, args)
+	if fs.NArg() != 1 {
+		util.LogFatal("usage: graph [--all] [--partition ID] PROJECT_ID")
+	}
+	projectID := fs.Arg(0)
+
+	report := collectReportOnce(cfg)
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		util.LogFatal("no security groups with ports found in project %s", projectID)
+	}
+
+	err := core.WriteDOT(os.Stdout, projectID, selectGraphPartitions(pr, *partitionID, *all))
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+}
+
+//Selects the partitions of a project that shall be rendered into a graph
+//(sorted descending by score).
+func selectGraphPartitions(pr *core.ProjectReport, partitionID string, all bool) []core.Partition {
+	var parts []core.PartitionReport
+	for _, part := range pr.Partitions {
+		if partitionID != "" && part.Partition.ID() != partitionID {
+			continue
+		}
+		if partitionID == "" && !all && part.Score.Value == 0 {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].Score.Value != parts[j].Score.Value {
+			return parts[i].Score.Value > parts[j].Score.Value
+		}
+		return parts[i].Partition.ID() < parts[j].Partition.ID()
+	})
+
+	result := make([]core.Partition, len(parts))
+	for idx, part := range parts {
+		result[idx] = part.Partition
+	}
+	return result
+}
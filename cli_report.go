@@ -0,0 +1,149 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Usage: report [--format table|json|csv] [--project ID] [--min-score N] [--top N] [--recommend] [--target N]
+//
+//Prints the partitions with the highest entanglement scores. With
+//--recommend, also prints recommended changes to bring each partition's score
+//down to the --target.
+func commandReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "table", "output format (table, json or csv)")
+	projectID := fs.String("project", "", "only report partitions in the project with this ID")
+	minScore := fs.Uint64("min-score", 1, "only report partitions with at least this score")
+	top := fs.Int("top", 20, "only report this many partitions (0 = unlimited)")
+	recommend := fs.Bool("recommend", false, "recommend changes that reduce the score of each partition")
+	target := fs.Uint64("target", 0, "score that recommended changes shall achieve (default: RECOMMENDATION_TARGET)")
+	cfg := parseCommandFlags(fs, args)
+	if !isFlagSet(fs, "target") {
+		*target = cfg.RecommendationTarget
+	}
+	if fs.NArg() != 0 {
+		util.LogFatal("usage: report [--format table|json|csv] [--project ID] [--min-score N] [--top N] [--recommend] [--target N]")
+	}
+	if *format != "table" && *format != "json" && *format != "csv" {
+		util.LogFatal("unknown output format: %s", *format)
+	}
+
+	report := collectReportOnce(cfg)
+
+	var partitions []apiTopPartition
+	partitionsByID := make(map[string]core.PartitionReport)
+	for _, pr := range report.Projects {
+		if *projectID != "" && pr.Project.UUID != *projectID {
+			continue
+		}
+		for _, part := range pr.Partitions {
+			if part.Score.Value >= *minScore {
+				partitions = append(partitions, apiTopPartition{pr.Project.UUID, renderPartition(part)})
+				partitionsByID[part.Partition.ID()] = part
+			}
+		}
+	}
+	sortTopPartitions(partitions)
+	if *top > 0 && len(partitions) > *top {
+		partitions = partitions[:*top]
+	}
+	if *recommend {
+		for idx, part := range partitions {
+			partitions[idx] = apiTopPartition{part.ProjectID, renderPartitionWithRecommendations(partitionsByID[part.ID], *target)}
+		}
+	}
+
+	var err error
+	switch *format {
+	case "table":
+		err = printReportTable(partitions)
+	case "json":
+		if partitions == nil {
+			partitions = []apiTopPartition{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(partitions)
+	case "csv":
+		err = printReportCSV(partitions)
+	}
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+}
+
+func printReportTable(partitions []apiTopPartition) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tPARTITION\tSCORE\tGROUPS\tTOP REASON")
+	for _, part := range partitions {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n",
+			part.ProjectID, part.ID, part.Score.Value, len(part.SecurityGroups), topReason(part.Score),
+		)
+		for _, r := range part.Recommendations {
+			fmt.Fprintf(w, "\t\t\t\t-> %s (-%d, total -%d)\n", r.Description, r.ScoreReduction, r.TotalScoreReduction)
+		}
+		if part.TargetReached != nil && !*part.TargetReached {
+			fmt.Fprintf(w, "\t\t\t\t-> target not reached (score after recommended changes: %d)\n", *part.ScoreAfterRecommendations)
+		}
+	}
+	return w.Flush()
+}
+
+func printReportCSV(partitions []apiTopPartition) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"project_id", "partition_id", "score", "group_count", "security_group_ids", "top_reason"})
+	for _, part := range partitions {
+		groupIDs := make([]string, len(part.SecurityGroups))
+		for idx, group := range part.SecurityGroups {
+			groupIDs[idx] = group.UUID
+		}
+		w.Write([]string{
+			part.ProjectID,
+			part.ID,
+			strconv.FormatUint(part.Score.Value, 10),
+			strconv.Itoa(len(part.SecurityGroups)),
+			strings.Join(groupIDs, " "),
+			topReason(part.Score),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+//Returns the reason of the highest-valued factor (renderPartition() has
+//already sorted the factors).
+func topReason(score core.Score) string {
+	if len(score.Factors) == 0 {
+		return ""
+	}
+	return score.Factors[0].Reason
+}
@@ -0,0 +1,154 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Usage: simulate [--format table|json] PROJECT_ID MUTATIONS_FILE
+//
+//Applies the mutations from the given JSON file (a list of core.Mutation, or
+//"-" to read from stdin) to the given project, and prints the scores before
+//and after.
+func commandSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	format := fs.String("format", "table", "output format (table or json)")
+	cfg := parseCommandFlags(fs, args)
+	if fs.NArg() != 2 {
+		util.LogFatal("usage: simulate [--format table|json] PROJECT_ID MUTATIONS_FILE")
+	}
+	if *format != "table" && *format != "json" {
+		util.LogFatal("unknown output format: %s", *format)
+	}
+	projectID := fs.Arg(0)
+
+	var mutations []core.Mutation
+	err := readJSONFile(fs.Arg(1), &mutations)
+	if err != nil {
+		util.LogFatal("cannot read mutations: " + err.Error())
+	}
+
+	report := collectReportOnce(cfg)
+	pr, exists := report.Projects[projectID]
+	if !exists {
+		util.LogFatal("no security groups with ports found in project %s", projectID)
+	}
+	result, err := core.Simulate(pr.Project, mutations)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(renderSimulation(result))
+	} else {
+		err = printSimulationTable(result)
+	}
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+}
+
+func printSimulationTable(result *core.SimulationResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tMAX SCORE\tTOTAL SCORE\tPARTITIONS")
+	fmt.Fprintf(w, "before\t%d\t%d\t%d\n", result.Before.MaxScore, result.Before.TotalScore, len(result.Before.Partitions))
+	fmt.Fprintf(w, "after\t%d\t%d\t%d\n", result.After.MaxScore, result.After.TotalScore, len(result.After.Partitions))
+	fmt.Fprintln(w)
+
+	//partitions with unchanged membership have the same ID before and after
+	type row struct {
+		ID            string
+		Before, After *core.PartitionReport
+		SortKey       uint64
+	}
+	rowsByID := make(map[string]*row)
+	getRow := func(part core.PartitionReport) *row {
+		id := part.Partition.ID()
+		if rowsByID[id] == nil {
+			rowsByID[id] = &row{ID: id}
+		}
+		if rowsByID[id].SortKey < part.Score.Value {
+			rowsByID[id].SortKey = part.Score.Value
+		}
+		return rowsByID[id]
+	}
+	for _, part := range result.Before.Partitions {
+		part := part
+		getRow(part).Before = &part
+	}
+	for _, part := range result.After.Partitions {
+		part := part
+		getRow(part).After = &part
+	}
+
+	var rows []*row
+	for _, r := range rowsByID {
+		if r.SortKey > 0 {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].SortKey != rows[j].SortKey {
+			return rows[i].SortKey > rows[j].SortKey
+		}
+		return rows[i].ID < rows[j].ID
+	})
+
+	fmt.Fprintln(w, "PARTITION\tBEFORE\tAFTER\tGROUPS")
+	for _, r := range rows {
+		before, after, groupCount := "-", "-", 0
+		if r.Before != nil {
+			before = fmt.Sprintf("%d", r.Before.Score.Value)
+			groupCount = len(r.Before.Partition)
+		}
+		if r.After != nil {
+			after = fmt.Sprintf("%d", r.After.Score.Value)
+			groupCount = len(r.After.Partition)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", r.ID, before, after, groupCount)
+	}
+	return w.Flush()
+}
+
+//Reads a JSON file into the given target. The path "-" refers to stdin.
+func readJSONFile(path string, target interface{}) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return json.NewDecoder(r).Decode(target)
+}
@@ -20,31 +20,80 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"math/rand"
 	"net/http"
+	"os"
 	"time"
 
+	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/history"
 	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
 )
 
+//reused across collections to retain the Keystone token
+var neutronClient *core.NeutronClient
+
+//reused across collections to retain the connection pool
+var neutronDB *sql.DB
+
+//holds the report from the most recent collection
+var collector *entanglementCollector
+
+//records the reports from all collections (nil if HISTORY_FILE is not set)
+var historyStore *history.Store
+
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	cfg := core.ReadConfigFromEnv()
+	core.UseScorer(cfg.Scorer)
+	setupDataSource(cfg)
+	rand.Seed(time.Now().UnixNano()) //for the collection jitter
 
-	prometheus.MustRegister(maxEntanglementGauge)
-	prometheus.MustRegister(totalEntanglementGauge)
-	go func() {
-		for {
-			collectMetrics(cfg)
-			time.Sleep(5 * time.Minute)
+	if cfg.ListenAddress == "" {
+		util.LogFatal("missing LISTEN_ADDRESS environment variable")
+	}
+	collector = &entanglementCollector{
+		exportPartitions: cfg.ExportPartitionMetrics,
+		exportTopFactors: int(cfg.ExportTopFactors),
+	}
+	if cfg.HistoryPath != "" {
+		var err error
+		historyStore, err = history.Open(cfg.HistoryPath, cfg.HistoryRetention)
+		if err != nil {
+			util.LogFatal("cannot open history database: " + err.Error())
 		}
-	}()
+		defer historyStore.Close()
+	}
+	prometheus.MustRegister(collector)
+	prometheus.MustRegister(collectionErrorsCounter)
+	prometheus.MustRegister(queryTimeoutsCounter)
+	prometheus.MustRegister(inconsistentRowsCounter)
+	prometheus.MustRegister(collectionDurationHistogram)
+	//buffered, so that triggers arriving during a collection are not lost (but
+	//multiple such triggers only cause one additional collection)
+	collectTrigger := make(chan struct{}, 1)
+	go collectionLoop(cfg, collectTrigger)
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/api/v1/", apiHandler{
+		collector:            collector,
+		history:              historyStore,
+		recommendationTarget: cfg.RecommendationTarget,
+		collectTrigger:       collectTrigger,
+		collectTriggerToken:  cfg.CollectTriggerToken,
+	})
 	util.LogInfo("listening on " + cfg.ListenAddress)
 	err := http.ListenAndServe(cfg.ListenAddress, nil)
 	if err != nil && err != http.ErrServerClosed {
@@ -52,54 +101,155 @@ func main() {
 	}
 }
 
-var maxEntanglementGauge = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "security_group_max_entanglement",
-		Help: "Highest entanglement score for an inter-connected set of security groups in this project.",
-	},
-	[]string{"project_id"},
+const (
+	minRetryInterval     = 10 * time.Second
+	retryBackoffMultiple = 2
 )
 
-var totalEntanglementGauge = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "security_group_total_entanglement",
-		Help: "Sum of entanglement scores for all inter-connected sets of security groups in this project.",
-	},
-	[]string{"project_id"},
-)
+//Runs collectMetrics() forever, once per cfg.CollectionInterval (plus
+//jitter), or earlier when something is received on the trigger channel. When
+//a collection fails, the last good report remains in place and the
+//collection is retried with exponential backoff (up to the collection
+//interval).
+func collectionLoop(cfg core.Config, trigger <-chan struct{}) {
+	retryInterval := minRetryInterval
+	for {
+		var sleepInterval time.Duration
+		err := collectMetrics(cfg)
+		if err == nil {
+			retryInterval = minRetryInterval
+			sleepInterval = cfg.CollectionInterval
+			if cfg.CollectionJitter > 0 {
+				sleepInterval += time.Duration(rand.Int63n(int64(cfg.CollectionJitter)))
+			}
+		} else {
+			collectionErrorsCounter.Inc()
+			util.LogError("collection failed (retrying in %s): %s", retryInterval, err.Error())
+			sleepInterval = retryInterval
+			retryInterval *= retryBackoffMultiple
+			if retryInterval > cfg.CollectionInterval {
+				retryInterval = cfg.CollectionInterval
+			}
+		}
 
-func collectMetrics(cfg core.Config) {
-	db, err := sql.Open("postgres", cfg.PostgresURI)
-	if err != nil {
-		util.LogFatal("cannot connect to Neutron DB: " + err.Error())
+		select {
+		case <-time.After(sleepInterval):
+		case <-trigger:
+			util.LogInfo("collection was triggered via API")
+		}
+	}
+}
+
+func setupDataSource(cfg core.Config) {
+	switch cfg.DataSource {
+	case core.DataSourceNeutronAPI:
+		neutronClient = core.NewNeutronClient(cfg)
+	case core.DataSourceDatabase:
+		var err error
+		neutronDB, err = core.OpenDatabase(cfg)
+		if err != nil {
+			util.LogFatal("cannot connect to Neutron DB: " + err.Error())
+		}
+	}
+}
+
+func collectData(cfg core.Config) (map[string]*core.Project, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CollectionTimeout)
+	defer cancel()
+
+	switch cfg.DataSource {
+	case core.DataSourceNeutronAPI:
+		projects, err := core.CollectDataFromNeutronAPI(ctx, neutronClient)
+		if err != nil {
+			return nil, errors.New("cannot query Neutron API: " + err.Error())
+		}
+		return projects, nil
+	case core.DataSourceSnapshot:
+		snapshot, err := core.ReadSnapshotFile(cfg.SnapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		return snapshot.Projects, nil
 	}
-	defer db.Close()
 
-	projects, err := core.CollectData(db, cfg)
+	projects, inconsistentRows, err := core.CollectData(ctx, neutronDB, cfg)
 	if err != nil {
-		util.LogFatal("cannot query Neutron DB: " + err.Error())
+		if qerr, ok := err.(core.QueryError); ok && qerr.TimedOut {
+			queryTimeoutsCounter.WithLabelValues(qerr.QueryName).Inc()
+		}
+		return nil, errors.New("cannot query Neutron DB: " + err.Error())
 	}
+	for queryName, count := range inconsistentRows {
+		if count > 0 {
+			util.LogError("ignored %d rows from query %s that refer to nonexistent security groups", count, queryName)
+		}
+		inconsistentRowsCounter.WithLabelValues(queryName).Add(float64(count))
+	}
+	return projects, nil
+}
 
-	for projectID, project := range projects {
-		var (
-			maxScore   uint64
-			totalScore uint64
-		)
+func collectMetrics(cfg core.Config) error {
+	startedAt := time.Now()
+	projects, err := collectData(cfg)
+	collectionDurationHistogram.Observe(time.Since(startedAt).Seconds())
+	if err != nil {
+		return err
+	}
+	report := core.NewReport(projects, startedAt)
 
-		for _, partition := range project.PartitionSecurityGroups() {
-			score := partition.Score()
-			totalScore += score.Value
-			if maxScore < score.Value {
-				maxScore = score.Value
+	for projectID, pr := range report.Projects {
+		for _, part := range pr.Partitions {
+			if part.Score.Value > cfg.ScoreLogLimit {
+				part.Partition.LogScore(part.Score, projectID)
+				recommendations, remainingScore := part.Partition.Recommend(cfg.RecommendationTarget)
+				part.Partition.LogRecommendations(recommendations, remainingScore, projectID, cfg.RecommendationTarget)
 			}
+		}
+	}
 
-			if score.Value > cfg.ScoreLogLimit {
-				partition.LogScore(score, projectID)
-			}
+	if cfg.ScoreGrowthLogRatio > 0 {
+		logScoreGrowth(collector.Report(), report, cfg.ScoreGrowthLogRatio)
+	}
+	collector.SetReport(report)
+
+	//failing to record history is not fatal since the metrics are already there
+	if historyStore != nil {
+		err := historyStore.Record(report)
+		if err != nil {
+			util.LogError("cannot record history: " + err.Error())
 		}
+	}
+	return nil
+}
 
-		labels := prometheus.Labels{"project_id": projectID}
-		maxEntanglementGauge.With(labels).Set(float64(maxScore))
-		totalEntanglementGauge.With(labels).Set(float64(totalScore))
+//Explains the changes in all projects whose maximum score grew by more than
+//the given ratio between two collections.
+func logScoreGrowth(previous, current *core.Report, ratio float64) {
+	if previous == nil {
+		return
+	}
+	for projectID, pr := range current.Projects {
+		previousPR, exists := previous.Projects[projectID]
+		if !exists {
+			continue
+		}
+		if float64(ownMaxScore(pr)) > ratio*float64(ownMaxScore(previousPR)) {
+			core.Diff(previousPR.Project, pr.Project).LogDiff()
+		}
+	}
+}
+
+//Returns the maximum score of the given project when edges to security
+//groups in other projects are ignored, like core.Diff() does. Otherwise, the
+//diff could not explain the growth.
+func ownMaxScore(pr *core.ProjectReport) uint64 {
+	for _, part := range pr.Partitions {
+		for groupID := range part.Partition {
+			if _, exists := pr.Project.Groups[groupID]; !exists {
+				//partition spans multiple projects
+				return core.NewProjectReport(pr.Project).MaxScore
+			}
+		}
 	}
+	return pr.MaxScore
 }
@@ -0,0 +1,254 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+)
+
+var maxEntanglementDesc = prometheus.NewDesc(
+	"security_group_max_entanglement",
+	"Highest entanglement score for an inter-connected set of security groups in this project.",
+	[]string{"project_id"}, nil,
+)
+
+var totalEntanglementDesc = prometheus.NewDesc(
+	"security_group_total_entanglement",
+	"Sum of entanglement scores for all inter-connected sets of security groups in this project.",
+	[]string{"project_id"}, nil,
+)
+
+var factorEntanglementDesc = prometheus.NewDesc(
+	"security_group_factor_entanglement",
+	"Sum of entanglement scores for all inter-connected sets of security groups in this project, split by kind of contributing factor.",
+	[]string{"project_id", "factor"}, nil,
+)
+
+var foreignEntanglementDesc = prometheus.NewDesc(
+	"security_group_foreign_entanglement",
+	"Part of security_group_total_entanglement that is attributed to security groups of the foreign project (e.g. because they are shared via RBAC). Only reported for non-zero values.",
+	[]string{"project_id", "foreign_project_id"}, nil,
+)
+
+var hostEntanglementDesc = prometheus.NewDesc(
+	"security_group_host_entanglement",
+	"Sum of entanglement scores for all inter-connected sets of security groups on this host, counting only the ports bound to this host.",
+	[]string{"host"}, nil,
+)
+
+var topFactorEntanglementDesc = prometheus.NewDesc(
+	"security_group_top_factor_entanglement",
+	"Contribution of an individual security group rule set to the entanglement score. Only reported for the highest-valued factors in each project.",
+	[]string{"project_id", "factor", "security_group", "security_group_name", "remote_security_group", "remote_security_group_name"}, nil,
+)
+
+var partitionEntanglementDesc = prometheus.NewDesc(
+	"security_group_partition_entanglement",
+	"Entanglement score for an inter-connected set of security groups. Only reported for partitions with non-zero score.",
+	[]string{"project_id", "partition_id", "group_count"}, nil,
+)
+
+var partitionInfoDesc = prometheus.NewDesc(
+	"security_group_partition_info",
+	"Always 1. Maps partitions reported in security_group_partition_entanglement to their member security groups.",
+	[]string{"project_id", "partition_id", "security_group_id", "security_group_name"}, nil,
+)
+
+var lastSuccessfulCollectionDesc = prometheus.NewDesc(
+	"secgroup_entanglement_last_successful_collection_timestamp_seconds",
+	"UNIX timestamp of the last successful collection of security group data.",
+	nil, nil,
+)
+
+var scoringModelInfoDesc = prometheus.NewDesc(
+	"secgroup_entanglement_scoring_model_info",
+	"Always 1. Reports the name of the scoring model that computed the entanglement scores.",
+	[]string{"model"}, nil,
+)
+
+var collectionErrorsCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "secgroup_entanglement_collection_errors_total",
+		Help: "Number of failed collections of security group data.",
+	},
+)
+
+var queryTimeoutsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secgroup_entanglement_query_timeouts_total",
+		Help: "Number of collections that failed because a query against the Neutron DB timed out, split by query.",
+	},
+	[]string{"query"},
+)
+
+var inconsistentRowsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secgroup_entanglement_inconsistent_rows_total",
+		Help: "Number of result rows from the Neutron DB that were ignored because they refer to nonexistent security groups, split by query.",
+	},
+	[]string{"query"},
+)
+
+var collectionDurationHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "secgroup_entanglement_collection_duration_seconds",
+		Help:    "Duration of collections of security group data (including failed ones).",
+		Buckets: []float64{1, 2.5, 5, 10, 25, 50, 100, 250},
+	},
+)
+
+//entanglementCollector is a prometheus.Collector that reports the metrics
+//from the most recent core.Report. Since the report is replaced as a whole,
+//projects that do not exist anymore disappear from the metrics, and a scrape
+//never sees a half-updated set of values.
+type entanglementCollector struct {
+	//whether to report security_group_partition_{entanglement,info}
+	exportPartitions bool
+	//how many factors to report in security_group_top_factor_entanglement
+	exportTopFactors int
+
+	mutex  sync.RWMutex
+	report *core.Report
+}
+
+//SetReport replaces the report that is used by Collect().
+func (c *entanglementCollector) SetReport(report *core.Report) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.report = report
+}
+
+//Report returns the most recent report, or nil if there is none yet.
+func (c *entanglementCollector) Report() *core.Report {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.report
+}
+
+//Describe implements the prometheus.Collector interface.
+func (c *entanglementCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSuccessfulCollectionDesc
+	ch <- scoringModelInfoDesc
+	ch <- maxEntanglementDesc
+	ch <- totalEntanglementDesc
+	ch <- factorEntanglementDesc
+	ch <- foreignEntanglementDesc
+	ch <- hostEntanglementDesc
+	if c.exportTopFactors > 0 {
+		ch <- topFactorEntanglementDesc
+	}
+	if c.exportPartitions {
+		ch <- partitionEntanglementDesc
+		ch <- partitionInfoDesc
+	}
+}
+
+//Collect implements the prometheus.Collector interface.
+func (c *entanglementCollector) Collect(ch chan<- prometheus.Metric) {
+	report := c.Report()
+	if report == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		lastSuccessfulCollectionDesc, prometheus.GaugeValue,
+		float64(report.CollectedAt.UnixNano())/1e9,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		scoringModelInfoDesc, prometheus.GaugeValue,
+		1, report.ScoringModel,
+	)
+
+	for host, score := range report.HostScores {
+		ch <- prometheus.MustNewConstMetric(
+			hostEntanglementDesc, prometheus.GaugeValue,
+			float64(score), host,
+		)
+	}
+
+	for projectID, pr := range report.Projects {
+		ch <- prometheus.MustNewConstMetric(
+			maxEntanglementDesc, prometheus.GaugeValue,
+			float64(pr.MaxScore), projectID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			totalEntanglementDesc, prometheus.GaugeValue,
+			float64(pr.TotalScore), projectID,
+		)
+
+		for _, kind := range core.AllFactorKinds {
+			ch <- prometheus.MustNewConstMetric(
+				factorEntanglementDesc, prometheus.GaugeValue,
+				float64(pr.TotalScoreByFactorKind[kind]), projectID, string(kind),
+			)
+		}
+		for foreignProjectID, score := range pr.ForeignScores {
+			ch <- prometheus.MustNewConstMetric(
+				foreignEntanglementDesc, prometheus.GaugeValue,
+				float64(score), projectID, foreignProjectID,
+			)
+		}
+
+		if c.exportTopFactors > 0 {
+			c.collectTopFactors(ch, projectID, pr)
+		}
+		if c.exportPartitions {
+			c.collectPartitions(ch, projectID, pr)
+		}
+	}
+}
+
+func (c *entanglementCollector) collectTopFactors(ch chan<- prometheus.Metric, projectID string, pr *core.ProjectReport) {
+	for _, factor := range pr.TopFactors(c.exportTopFactors) {
+		//the groups can be in other projects if the partition spans multiple projects
+		group := pr.SecurityGroup(factor.SecurityGroupID)
+		remoteGroup := pr.SecurityGroup(factor.RemoteSecurityGroupID)
+		ch <- prometheus.MustNewConstMetric(
+			topFactorEntanglementDesc, prometheus.GaugeValue,
+			float64(factor.Value), projectID, string(factor.Kind),
+			group.UUID, group.Name, remoteGroup.UUID, remoteGroup.Name,
+		)
+	}
+}
+
+func (c *entanglementCollector) collectPartitions(ch chan<- prometheus.Metric, projectID string, pr *core.ProjectReport) {
+	for _, part := range pr.Partitions {
+		if part.Score.Value == 0 {
+			continue
+		}
+
+		partitionID := part.Partition.ID()
+		ch <- prometheus.MustNewConstMetric(
+			partitionEntanglementDesc, prometheus.GaugeValue,
+			float64(part.Score.Value), projectID, partitionID, strconv.Itoa(len(part.Partition)),
+		)
+		for groupID, group := range part.Partition {
+			ch <- prometheus.MustNewConstMetric(
+				partitionInfoDesc, prometheus.GaugeValue,
+				1, projectID, partitionID, groupID, group.Name,
+			)
+		}
+	}
+}
@@ -19,26 +19,100 @@
 package core
 
 import (
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
 )
 
+//DataSource identifies where the exporter reads data about security groups from.
+type DataSource string
+
+const (
+	//DataSourceDatabase reads directly from the Neutron DB (see CollectData).
+	DataSourceDatabase DataSource = "database"
+	//DataSourceNeutronAPI reads from the Neutron API (see CollectDataFromNeutronAPI).
+	DataSourceNeutronAPI DataSource = "neutron-api"
+	//DataSourceSnapshot reads from a snapshot file (see ReadSnapshotFile).
+	DataSourceSnapshot DataSource = "snapshot"
+)
+
 //Config contains the configuration for the exporter.
 type Config struct {
-	//URI for Neutron DB.
-	PostgresURI string
-	//Address to listen on for Prometheus metrics endpoint.
+	//Where to read data from (default: DataSourceDatabase).
+	DataSource DataSource
+	//URI for Neutron DB. The URI scheme selects the Dialect, e.g.
+	//"postgres://..." or "mysql://...".
+	DatabaseURI string
+	//Dialect matching the scheme of DatabaseURI.
+	Dialect Dialect
+	//Settings for the connection pool for DatabaseURI.
+	DatabasePool struct {
+		//Default: 1.
+		MaxOpenConnections int
+		//Default: 1.
+		MaxIdleConnections int
+		//Default: 0 (connections are reused forever).
+		ConnectionLifetime time.Duration
+		//Default: 0 (no timeout).
+		StatementTimeout time.Duration
+	}
+	//Path to snapshot file (only used for DataSourceSnapshot).
+	SnapshotPath string
+	//Address to listen on for Prometheus metrics endpoint (only required when
+	//running as an exporter, not for one-off commands).
 	ListenAddress string
+	//How often data is collected (default: 5 minutes).
+	CollectionInterval time.Duration
+	//Up to this much time is added at random to each collection interval, so
+	//that exporters in multiple regions do not query at the same time
+	//(default: 0).
+	CollectionJitter time.Duration
+	//Deadline for all queries of one collection from the Neutron DB or the
+	//Neutron API (default: 5 minutes).
+	CollectionTimeout time.Duration
+	//Deadline for each individual query or API request (default: 2 minutes).
+	QueryTimeout time.Duration
+	//If not empty, a collection can be triggered by POSTing to
+	///api/v1/collect with this token (default: empty, i.e. disabled).
+	CollectTriggerToken string
 	//Partitions with score higher than this will be logged (default: 50).
 	ScoreLogLimit uint64
+	//For logged partitions, changes are recommended that reduce the score to
+	//this value (default: same as ScoreLogLimit).
+	RecommendationTarget uint64
+	//When a project's maximum score grows by more than this factor between two
+	//collections, the changes causing the growth will be logged (default: 2).
+	//Set to 0 to disable.
+	ScoreGrowthLogRatio float64
+	//The scoring model (default: DefaultScorer()). Must be activated with
+	//UseScorer().
+	Scorer Scorer
+	//Whether to export metrics for each partition (default: false).
+	ExportPartitionMetrics bool
+	//How many of the highest-valued score factors to export per project (default: 0).
+	ExportTopFactors uint64
+	//Path to history database file (default: empty, i.e. no history is recorded).
+	HistoryPath string
+	//How long records are kept in the history database (default: 1 year).
+	HistoryRetention time.Duration
 
-	//Parts of the database schema that change between Neutron versions.
-	DatabaseSchema struct {
-		ProjectIDColumnName string
+	//Access to the Neutron API (only used for DataSourceNeutronAPI).
+	NeutronAPI struct {
+		//If given, overrides the endpoint from the Keystone catalog.
+		Endpoint string
+		//If given together with Endpoint, Auth is not required.
+		Token string
+		Auth  KeystoneAuth
 	}
+
+	//Parts of the database schema that change between Neutron versions. This
+	//is only set if NEUTRON_RELEASE is given. Otherwise, CollectData() detects
+	//the schema with DetectDatabaseSchema().
+	DatabaseSchema *DatabaseSchema
 }
 
 func mustGetenv(key string) string {
@@ -52,11 +126,72 @@ func mustGetenv(key string) string {
 //ReadConfigFromEnv reads the supported environment variables into a Config
 //object, or panics if the given configuration is broken or incomplete.
 func ReadConfigFromEnv() Config {
+	return ReadConfigFromEnvWithSnapshot("")
+}
+
+//ReadConfigFromEnvWithSnapshot is like ReadConfigFromEnv, but if a snapshot
+//path is given, it selects DataSourceSnapshot regardless of the DATA_SOURCE
+//environment variable.
+func ReadConfigFromEnvWithSnapshot(snapshotPath string) Config {
 	cfg := Config{
-		PostgresURI:   mustGetenv("POSTGRES_URI"),
-		ListenAddress: mustGetenv("LISTEN_ADDRESS"),
+		DataSource:    DataSource(os.Getenv("DATA_SOURCE")),
+		ListenAddress: os.Getenv("LISTEN_ADDRESS"),
 		ScoreLogLimit: 50,
 	}
+	if snapshotPath != "" {
+		cfg.DataSource = DataSourceSnapshot
+	}
+	if cfg.DataSource == "" {
+		cfg.DataSource = DataSourceDatabase
+	}
+
+	switch cfg.DataSource {
+	case DataSourceDatabase:
+		readDatabaseConfigFromEnv(&cfg)
+	case DataSourceNeutronAPI:
+		readNeutronAPIConfigFromEnv(&cfg)
+	case DataSourceSnapshot:
+		cfg.SnapshotPath = snapshotPath
+		if cfg.SnapshotPath == "" {
+			cfg.SnapshotPath = mustGetenv("SNAPSHOT_FILE")
+		}
+	default:
+		util.LogFatal("unknown value found in DATA_SOURCE environment variable")
+	}
+
+	cfg.CollectionInterval = 5 * time.Minute
+	if str := os.Getenv("COLLECTION_INTERVAL"); str != "" {
+		var err error
+		cfg.CollectionInterval, err = time.ParseDuration(str)
+		if err != nil || cfg.CollectionInterval <= 0 {
+			util.LogFatal("invalid value for COLLECTION_INTERVAL: %q", str)
+		}
+	}
+	if str := os.Getenv("COLLECTION_JITTER"); str != "" {
+		var err error
+		cfg.CollectionJitter, err = time.ParseDuration(str)
+		if err != nil || cfg.CollectionJitter < 0 {
+			util.LogFatal("invalid value for COLLECTION_JITTER: %q", str)
+		}
+	}
+	cfg.CollectionTimeout = 5 * time.Minute
+	if str := os.Getenv("COLLECTION_TIMEOUT"); str != "" {
+		var err error
+		cfg.CollectionTimeout, err = time.ParseDuration(str)
+		if err != nil || cfg.CollectionTimeout <= 0 {
+			util.LogFatal("invalid value for COLLECTION_TIMEOUT: %q", str)
+		}
+	}
+	cfg.QueryTimeout = 2 * time.Minute
+	if str := os.Getenv("QUERY_TIMEOUT"); str != "" {
+		var err error
+		cfg.QueryTimeout, err = time.ParseDuration(str)
+		if err != nil || cfg.QueryTimeout <= 0 {
+			util.LogFatal("invalid value for QUERY_TIMEOUT: %q", str)
+		}
+	}
+	cfg.CollectTriggerToken = os.Getenv("COLLECT_TRIGGER_TOKEN")
+
 	if str := os.Getenv("SCORE_LOG_LIMIT"); str != "" {
 		var err error
 		cfg.ScoreLogLimit, err = strconv.ParseUint(str, 10, 64)
@@ -64,21 +199,133 @@ func ReadConfigFromEnv() Config {
 			util.LogFatal("invalid value for SCORE_LOG_LIMIT: " + err.Error())
 		}
 	}
-	switch mustGetenv("NEUTRON_RELEASE") {
-	case "kilo", "liberty", "mitaka":
-		cfg.DatabaseSchema.ProjectIDColumnName = "tenant_id"
-	case "newton", "ocata", "pike", "queens":
-		cfg.DatabaseSchema.ProjectIDColumnName = "project_id"
-	default:
-		util.LogFatal("unknown value found in NEUTRON_RELEASE environment variable")
+	cfg.RecommendationTarget = cfg.ScoreLogLimit
+	if str := os.Getenv("RECOMMENDATION_TARGET"); str != "" {
+		var err error
+		cfg.RecommendationTarget, err = strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			util.LogFatal("invalid value for RECOMMENDATION_TARGET: " + err.Error())
+		}
+	}
+	cfg.Scorer = ReadScorerFromEnv()
+	cfg.ScoreGrowthLogRatio = 2
+	if str := os.Getenv("SCORE_GROWTH_LOG_RATIO"); str != "" {
+		var err error
+		cfg.ScoreGrowthLogRatio, err = strconv.ParseFloat(str, 64)
+		if err != nil || cfg.ScoreGrowthLogRatio < 0 {
+			util.LogFatal("invalid value for SCORE_GROWTH_LOG_RATIO: %q", str)
+		}
+	}
+	cfg.ExportPartitionMetrics = os.Getenv("EXPORT_PARTITION_METRICS") == "1"
+	if str := os.Getenv("EXPORT_TOP_FACTORS"); str != "" {
+		var err error
+		cfg.ExportTopFactors, err = strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			util.LogFatal("invalid value for EXPORT_TOP_FACTORS: " + err.Error())
+		}
+	}
+	cfg.HistoryPath = os.Getenv("HISTORY_FILE")
+	cfg.HistoryRetention = 365 * 24 * time.Hour
+	if str := os.Getenv("HISTORY_RETENTION"); str != "" {
+		var err error
+		cfg.HistoryRetention, err = time.ParseDuration(str)
+		if err != nil || cfg.HistoryRetention <= 0 {
+			util.LogFatal("invalid value for HISTORY_RETENTION: %q", str)
+		}
 	}
 
 	return cfg
 }
 
+//ReadScorerFromEnv reads the scoring model from the file given in the
+//SCORING_CONFIG environment variable, or returns DefaultScorer() if the
+//variable is not set.
+func ReadScorerFromEnv() Scorer {
+	path := os.Getenv("SCORING_CONFIG")
+	if path == "" {
+		return DefaultScorer()
+	}
+	s, err := ReadScorerFile(path)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+	return s
+}
+
+func readDatabaseConfigFromEnv(cfg *Config) {
+	cfg.DatabaseURI = os.Getenv("DATABASE_URI")
+	if cfg.DatabaseURI == "" {
+		//POSTGRES_URI is the historical name of DATABASE_URI
+		cfg.DatabaseURI = mustGetenv("POSTGRES_URI")
+	}
+	uri, err := url.Parse(cfg.DatabaseURI)
+	if err != nil {
+		util.LogFatal("invalid value for DATABASE_URI: " + err.Error())
+	}
+	cfg.Dialect, err = DialectForURI(uri)
+	if err != nil {
+		util.LogFatal("invalid value for DATABASE_URI: " + err.Error())
+	}
+
+	cfg.DatabasePool.MaxOpenConnections = 1
+	if str := os.Getenv("DATABASE_MAX_OPEN_CONNECTIONS"); str != "" {
+		cfg.DatabasePool.MaxOpenConnections, err = strconv.Atoi(str)
+		if err != nil || cfg.DatabasePool.MaxOpenConnections < 0 {
+			util.LogFatal("invalid value for DATABASE_MAX_OPEN_CONNECTIONS: %q", str)
+		}
+	}
+	cfg.DatabasePool.MaxIdleConnections = 1
+	if str := os.Getenv("DATABASE_MAX_IDLE_CONNECTIONS"); str != "" {
+		cfg.DatabasePool.MaxIdleConnections, err = strconv.Atoi(str)
+		if err != nil || cfg.DatabasePool.MaxIdleConnections < 0 {
+			util.LogFatal("invalid value for DATABASE_MAX_IDLE_CONNECTIONS: %q", str)
+		}
+	}
+	if str := os.Getenv("DATABASE_CONNECTION_LIFETIME"); str != "" {
+		cfg.DatabasePool.ConnectionLifetime, err = time.ParseDuration(str)
+		if err != nil || cfg.DatabasePool.ConnectionLifetime < 0 {
+			util.LogFatal("invalid value for DATABASE_CONNECTION_LIFETIME: %q", str)
+		}
+	}
+	if str := os.Getenv("DATABASE_STATEMENT_TIMEOUT"); str != "" {
+		cfg.DatabasePool.StatementTimeout, err = time.ParseDuration(str)
+		if err != nil || cfg.DatabasePool.StatementTimeout < 0 {
+			util.LogFatal("invalid value for DATABASE_STATEMENT_TIMEOUT: %q", str)
+		}
+	}
+
+	if release := os.Getenv("NEUTRON_RELEASE"); release != "" {
+		schema, err := DatabaseSchemaForRelease(release)
+		if err != nil {
+			util.LogFatal("invalid value for NEUTRON_RELEASE: " + err.Error())
+		}
+		cfg.DatabaseSchema = &schema
+	}
+}
+
+func readNeutronAPIConfigFromEnv(cfg *Config) {
+	cfg.NeutronAPI.Endpoint = os.Getenv("NEUTRON_ENDPOINT")
+	cfg.NeutronAPI.Token = os.Getenv("OS_TOKEN")
+	if cfg.NeutronAPI.Endpoint != "" && cfg.NeutronAPI.Token != "" {
+		return
+	}
+
+	cfg.NeutronAPI.Auth = KeystoneAuth{
+		AuthURL:           mustGetenv("OS_AUTH_URL"),
+		Username:          mustGetenv("OS_USERNAME"),
+		UserDomainName:    mustGetenv("OS_USER_DOMAIN_NAME"),
+		Password:          mustGetenv("OS_PASSWORD"),
+		ProjectName:       mustGetenv("OS_PROJECT_NAME"),
+		ProjectDomainName: mustGetenv("OS_PROJECT_DOMAIN_NAME"),
+		RegionName:        os.Getenv("OS_REGION_NAME"),
+		Interface:         os.Getenv("OS_INTERFACE"),
+	}
+}
+
 var projectIDColumnNameRx = regexp.MustCompile(`\bproject_id\b`)
 
-//Apply the variables in cfg.DatabaseSchema to the given query string.
+//Apply the variables in cfg.DatabaseSchema and cfg.Dialect to the given query string.
 func (cfg Config) applyTo(query string) string {
-	return projectIDColumnNameRx.ReplaceAllString(query, cfg.DatabaseSchema.ProjectIDColumnName)
+	query = projectIDColumnNameRx.ReplaceAllString(query, cfg.DatabaseSchema.ProjectIDColumnName)
+	return cfg.Dialect.Rebind(query)
 }
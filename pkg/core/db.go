@@ -19,122 +19,523 @@
 
 package core
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
 
 //Project contains all the data we collect about a project.
 type Project struct {
-	UUID   string
-	Groups map[string]*SecurityGroup
+	UUID string `json:"id"`
+	//key = group UUID
+	Groups map[string]*SecurityGroup `json:"security_groups"`
 }
 
 //SecurityGroup contains all the data we collect about a security group.
 type SecurityGroup struct {
-	Name      string
-	PortCount uint64
-	//How many ports are shared with another security group (key = remote group name).
-	SharedPortCount map[string]uint64
-	//How many remote rules referencing another security group this group contains (key = remote group name).
-	ReferenceCount map[string]uint64
+	UUID      string `json:"id"`
+	Name      string `json:"name"`
+	PortCount uint64 `json:"port_count"`
+	//How many ports are shared with another security group (key = remote group UUID).
+	SharedPortCount map[string]uint64 `json:"shared_port_count"`
+	//How many remote rules referencing another security group this group contains (key = remote group UUID).
+	ReferenceCount map[string]uint64 `json:"reference_count"`
+	//How many ports are in exactly the given set of security groups (key = see
+	//CombinationKey). Only sets of two or more groups are recorded, in each of
+	//the groups in the set.
+	PortCombinations map[string]uint64 `json:"port_combinations"`
+	//How many rules with a remote IP prefix (i.e. a CIDR) this group contains.
+	IPPrefixRuleCount uint64 `json:"ip_prefix_rule_count"`
+	//Rules referencing address groups (key = address group UUID).
+	AddressGroupReferences map[string]*AddressGroupReference `json:"address_group_references"`
+	//Like SharedPortCount, ReferenceCount and PortCombinations, but for
+	//security groups in other projects (e.g. because they are shared via
+	//RBAC). These are only considered when security groups from multiple
+	//projects are partitioned together (see PartitionAllSecurityGroups).
+	ForeignSharedPortCount  map[string]uint64 `json:"foreign_shared_port_count,omitempty"`
+	ForeignReferenceCount   map[string]uint64 `json:"foreign_reference_count,omitempty"`
+	ForeignPortCombinations map[string]uint64 `json:"foreign_port_combinations,omitempty"`
+	//Like PortCombinations, but split by the host that the ports are bound to
+	//(key = host name, then CombinationKey). Unlike PortCombinations, this
+	//includes sets of only one group, and combinations with groups in other
+	//projects.
+	HostPortCombinations map[string]map[string]uint64 `json:"host_port_combinations,omitempty"`
+}
+
+//Returns a SecurityGroup with all maps initialized.
+func newSecurityGroup(groupID, name string, portCount uint64) *SecurityGroup {
+	return &SecurityGroup{
+		UUID:                    groupID,
+		Name:                    name,
+		PortCount:               portCount,
+		SharedPortCount:         make(map[string]uint64),
+		ReferenceCount:          make(map[string]uint64),
+		PortCombinations:        make(map[string]uint64),
+		AddressGroupReferences:  make(map[string]*AddressGroupReference),
+		ForeignSharedPortCount:  make(map[string]uint64),
+		ForeignReferenceCount:   make(map[string]uint64),
+		ForeignPortCombinations: make(map[string]uint64),
+		HostPortCombinations:    make(map[string]map[string]uint64),
+	}
+}
+
+//SharedPortCountWith returns how many ports are shared with the given
+//security group, regardless of whether it is in the same project.
+func (g SecurityGroup) SharedPortCountWith(groupID string) uint64 {
+	return g.SharedPortCount[groupID] + g.ForeignSharedPortCount[groupID]
+}
+
+//ReferenceCountTo returns how many rules in this group reference the given
+//security group, regardless of whether it is in the same project.
+func (g SecurityGroup) ReferenceCountTo(groupID string) uint64 {
+	return g.ReferenceCount[groupID] + g.ForeignReferenceCount[groupID]
+}
+
+//Returns the UUIDs of all security groups that this group has references to
+//(in ReferenceCount or ForeignReferenceCount), without duplicates.
+func (g SecurityGroup) referencedGroupIDs() []string {
+	result := make([]string, 0, len(g.ReferenceCount)+len(g.ForeignReferenceCount))
+	for groupID := range g.ReferenceCount {
+		result = append(result, groupID)
+	}
+	for groupID := range g.ForeignReferenceCount {
+		if _, exists := g.ReferenceCount[groupID]; !exists {
+			result = append(result, groupID)
+		}
+	}
+	return result
+}
+
+//AddressGroupReference describes the rules in a security group that
+//reference one address group.
+type AddressGroupReference struct {
+	RuleCount uint64 `json:"rule_count"`
+	//Number of addresses in the referenced address group.
+	AddressCount uint64 `json:"address_count"`
+}
+
+//CombinationKey returns the key for SecurityGroup.PortCombinations that
+//identifies the given set of security groups.
+func CombinationKey(groupIDs []string) string {
+	ids := append([]string(nil), groupIDs...)
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+//CombinationGroupIDs is the inverse of CombinationKey.
+func CombinationGroupIDs(key string) []string {
+	return strings.Split(key, ",")
+}
+
+//Records that `portCount` ports are in exactly the given set of security
+//groups (identified by its CombinationKey), if all of them are in this
+//project.
+func (p *Project) setCombinationPortCount(key string, portCount uint64) {
+	groupIDs := CombinationGroupIDs(key)
+	for _, groupID := range groupIDs {
+		if _, exists := p.Groups[groupID]; !exists {
+			return
+		}
+	}
+	for _, groupID := range groupIDs {
+		if portCount == 0 {
+			delete(p.Groups[groupID].PortCombinations, key)
+		} else {
+			p.Groups[groupID].PortCombinations[key] = portCount
+		}
+	}
+}
+
+//groupDirectory finds security groups across all projects while collecting
+//data, and records edges between them in the SecurityGroup fields for either
+//the same project or for foreign projects.
+type groupDirectory struct {
+	projects map[string]*Project
+	//key = group UUID, value = project UUID
+	projectIDs map[string]string
+}
+
+func newGroupDirectory(projects map[string]*Project) groupDirectory {
+	d := groupDirectory{projects, make(map[string]string)}
+	for projectID, project := range projects {
+		for groupID := range project.Groups {
+			d.projectIDs[groupID] = projectID
+		}
+	}
+	return d
 }
 
+//Returns nil if the group does not exist.
+func (d groupDirectory) find(groupID string) (*SecurityGroup, string) {
+	projectID, exists := d.projectIDs[groupID]
+	if !exists {
+		return nil, ""
+	}
+	return d.projects[projectID].Groups[groupID], projectID
+}
+
+//The add...() methods are coded defensively: If one of the groups does not
+//exist, nothing is recorded and false is returned.
+
+func (d groupDirectory) addSharedPorts(groupID1, groupID2 string, portCount uint64) bool {
+	group1, projectID1 := d.find(groupID1)
+	group2, projectID2 := d.find(groupID2)
+	switch {
+	case group1 == nil || group2 == nil:
+		return false
+	case projectID1 == projectID2:
+		group1.SharedPortCount[groupID2] += portCount
+		group2.SharedPortCount[groupID1] += portCount
+	default:
+		group1.ForeignSharedPortCount[groupID2] += portCount
+		group2.ForeignSharedPortCount[groupID1] += portCount
+	}
+	return true
+}
+
+func (d groupDirectory) addReferences(groupID, remoteGroupID string, ruleCount uint64) bool {
+	group, projectID := d.find(groupID)
+	remoteGroup, remoteProjectID := d.find(remoteGroupID)
+	switch {
+	case group == nil || remoteGroup == nil:
+		return false
+	case projectID == remoteProjectID:
+		group.ReferenceCount[remoteGroupID] += ruleCount
+	default:
+		group.ForeignReferenceCount[remoteGroupID] += ruleCount
+	}
+	return true
+}
+
+//The combination is identified by its CombinationKey.
+func (d groupDirectory) addPortCombination(key string, portCount uint64) bool {
+	groupIDs := CombinationGroupIDs(key)
+	groups := make([]*SecurityGroup, len(groupIDs))
+	isForeign := false
+	for idx, groupID := range groupIDs {
+		var projectID string
+		groups[idx], projectID = d.find(groupID)
+		if groups[idx] == nil {
+			return false
+		}
+		if projectID != d.projectIDs[groupIDs[0]] {
+			isForeign = true
+		}
+	}
+	for _, group := range groups {
+		if isForeign {
+			group.ForeignPortCombinations[key] += portCount
+		} else {
+			group.PortCombinations[key] += portCount
+		}
+	}
+	return true
+}
+
+//The combination is identified by its CombinationKey.
+func (d groupDirectory) addHostPortCombination(host, key string, portCount uint64) bool {
+	groupIDs := CombinationGroupIDs(key)
+	groups := make([]*SecurityGroup, len(groupIDs))
+	for idx, groupID := range groupIDs {
+		groups[idx], _ = d.find(groupID)
+		if groups[idx] == nil {
+			return false
+		}
+	}
+	for _, group := range groups {
+		if group.HostPortCombinations[host] == nil {
+			group.HostPortCombinations[host] = make(map[string]uint64)
+		}
+		group.HostPortCombinations[host][key] += portCount
+	}
+	return true
+}
+
+//String returns a human-readable identifier for this security group. Since
+//group names are not unique, it includes both name and UUID.
+func (g SecurityGroup) String() string {
+	return g.Name + " (" + g.UUID + ")"
+}
+
+//NOTE: All queries are written in the PostgreSQL dialect and converted into
+//the configured Dialect by cfg.applyTo().
+
 var securityGroupsQuery = `
-	SELECT g.project_id, g.name, COUNT(b.port_id)
+	SELECT g.project_id, g.id, g.name, COUNT(b.port_id)
 	  FROM securitygroups g
 	  JOIN securitygroupportbindings b ON b.security_group_id = g.id
-	 GROUP BY g.project_id, g.name;
+	 GROUP BY g.project_id, g.id, g.name;
 `
 
 var sharedPortsQuery = `
-	SELECT COUNT(b1.port_id),
-		(SELECT name FROM securitygroups WHERE id = b1.security_group_id),
-		(SELECT name FROM securitygroups WHERE id = b2.security_group_id),
-		(SELECT project_id FROM securitygroups WHERE id = b1.security_group_id)
+	SELECT COUNT(b1.port_id), b1.security_group_id, b2.security_group_id
 	  FROM securitygroupportbindings b1
 	  JOIN securitygroupportbindings b2 ON b1.port_id = b2.port_id AND b1.security_group_id < b2.security_group_id
 	 GROUP BY b1.security_group_id, b2.security_group_id;
 `
 
-var remoteReferencesQuery = `
-	SELECT g1.project_id, g1.name, g2.name, COUNT(*)
+var portCombinationsQuery = `
+	SELECT c.security_group_ids, COUNT(*)
+	  FROM (
+	    SELECT string_agg(security_group_id, ',' ORDER BY security_group_id) AS security_group_ids
+	      FROM securitygroupportbindings
+	     GROUP BY port_id
+	    HAVING COUNT(*) > 1
+	  ) c
+	 GROUP BY c.security_group_ids;
+`
+
+//Only used if cfg.DatabaseSchema.HasPortBindings. The placeholder is filled
+//with a condition on the binding status if the schema has one.
+var hostPortCombinationsQuery = `
+	SELECT pb.host, c.security_group_ids, COUNT(*)
+	  FROM (
+	    SELECT port_id, string_agg(security_group_id, ',' ORDER BY security_group_id) AS security_group_ids
+	      FROM securitygroupportbindings
+	     GROUP BY port_id
+	  ) c
+	  JOIN ml2_port_bindings pb ON pb.port_id = c.port_id
+	 WHERE pb.host <> '' %s
+	 GROUP BY pb.host, c.security_group_ids;
+`
+
+var ipPrefixRulesQuery = `
+	SELECT g.project_id, r.security_group_id, COUNT(*)
+	  FROM securitygrouprules r
+	  JOIN securitygroups g ON g.id = r.security_group_id
+	 WHERE r.remote_ip_prefix IS NOT NULL
+	 GROUP BY g.project_id, r.security_group_id;
+`
+
+//Only used if cfg.DatabaseSchema.HasAddressGroups.
+var addressGroupReferencesQuery = `
+	SELECT g.project_id, r.security_group_id, r.remote_address_group_id, COUNT(*),
+	       (SELECT COUNT(*) FROM address_associations a WHERE a.address_group_id = r.remote_address_group_id)
 	  FROM securitygrouprules r
-	  JOIN securitygroups g1 ON g1.id = r.security_group_id
-	  JOIN securitygroups g2 ON g2.id = r.remote_group_id
-	 WHERE r.remote_group_id IS NOT NULL
-	 GROUP BY g1.project_id, g1.name, g2.name;
+	  JOIN securitygroups g ON g.id = r.security_group_id
+	 WHERE r.remote_address_group_id IS NOT NULL
+	 GROUP BY g.project_id, r.security_group_id, r.remote_address_group_id;
 `
 
-//CollectData gathers data about all security groups in all projects from the Neutron DB.
-func CollectData(db *sql.DB, cfg Config) (map[string]*Project, error) {
+var remoteReferencesQuery = `
+	SELECT security_group_id, remote_group_id, COUNT(*)
+	  FROM securitygrouprules
+	 WHERE remote_group_id IS NOT NULL
+	 GROUP BY security_group_id, remote_group_id;
+`
+
+//CollectData gathers data about all security groups in all projects from the
+//Neutron DB. Each query is aborted when it takes longer than
+//cfg.QueryTimeout, or when the given context expires. In both cases, a
+//QueryError is returned.
+//
+//All queries run in one read-only transaction with isolation level REPEATABLE
+//READ, so they see a consistent snapshot of the Neutron DB even when ports
+//are created or deleted during the collection. The second return value
+//counts result rows that had to be ignored anyway because they refer to
+//nonexistent security groups, by query name.
+func CollectData(ctx context.Context, db *sql.DB, cfg Config) (map[string]*Project, map[string]uint64, error) {
+	//the schema is detected anew for each collection since it changes when
+	//Neutron is upgraded
+	if cfg.DatabaseSchema == nil {
+		schema, err := DetectDatabaseSchema(ctx, db, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		util.LogDebug("detected Neutron DB schema: %+v", schema)
+		cfg.DatabaseSchema = &schema
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot begin transaction: %s", err.Error())
+	}
+	defer tx.Rollback() //the transaction is read-only, so there is nothing to commit
+	q := queryRunner{ctx, tx, cfg.QueryTimeout}
+
 	result := make(map[string]*Project)
+	inconsistentRows := make(map[string]uint64, len(inconsistentRowsQueryNames))
+	for _, queryName := range inconsistentRowsQueryNames {
+		inconsistentRows[queryName] = 0
+	}
+	countUnless := func(queryName string, ok bool) {
+		if !ok {
+			inconsistentRows[queryName]++
+		}
+	}
 
 	//list all security groups in all projects
 	var (
 		projectID string
+		groupID   string
 		groupName string
 		portCount uint64
 	)
-	err := scan(db, cfg.applyTo(securityGroupsQuery), args(&projectID, &groupName, &portCount), func() {
+	err = q.scan("security_groups", cfg.applyTo(securityGroupsQuery), args(&projectID, &groupID, &groupName, &portCount), func() {
 		project, exists := result[projectID]
 		if !exists {
 			project = &Project{projectID, make(map[string]*SecurityGroup)}
 			result[projectID] = project
 		}
-		project.Groups[groupName] = &SecurityGroup{
-			Name:            groupName,
-			PortCount:       portCount,
-			SharedPortCount: make(map[string]uint64),
-			ReferenceCount:  make(map[string]uint64),
-		}
+		project.Groups[groupID] = newSecurityGroup(groupID, groupName, portCount)
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	//the remaining queries can connect groups across project boundaries
+	directory := newGroupDirectory(result)
+
+	//The queries on securitygroupportbindings only find groups with ports, so
+	//the groups should always exist unless the Neutron DB is inconsistent.
 
 	//count ports shared by multiple security groups
 	var (
-		groupName1 string
-		groupName2 string
+		groupID1 string
+		groupID2 string
 	)
-	err = scan(db, cfg.applyTo(sharedPortsQuery), args(&portCount, &groupName1, &groupName2, &projectID), func() {
-		//This is coded defensively, but if the Neutron DB is consistent *cough*,
-		//we should never have `exists && exists1 && exists2 = false`
+	err = q.scan("shared_ports", cfg.applyTo(sharedPortsQuery), args(&portCount, &groupID1, &groupID2), func() {
+		countUnless("shared_ports", directory.addSharedPorts(groupID1, groupID2, portCount))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//count ports by the exact set of security groups they are in
+	var combinationKey string
+	err = q.scan("port_combinations", cfg.applyTo(portCombinationsQuery), args(&combinationKey, &portCount), func() {
+		countUnless("port_combinations", directory.addPortCombination(combinationKey, portCount))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//count ports on each host by the exact set of security groups they are in
+	if cfg.DatabaseSchema.HasPortBindings {
+		condition := ""
+		if cfg.DatabaseSchema.HasPortBindingStatus {
+			condition = "AND pb.status = 'ACTIVE'"
+		}
+		var host string
+		query := fmt.Sprintf(hostPortCombinationsQuery, condition)
+		err = q.scan("host_port_combinations", cfg.applyTo(query), args(&host, &combinationKey, &portCount), func() {
+			countUnless("host_port_combinations", directory.addHostPortCombination(host, combinationKey, portCount))
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//The queries on securitygrouprules also find groups without ports, which
+	//are not in `result` and do not contribute to any scores, so rows for
+	//those groups are skipped without counting them as inconsistent.
+
+	//find security groups with rules referencing other security groups
+	var (
+		remoteGroupID  string
+		referenceCount uint64
+	)
+	err = q.scan("remote_references", cfg.applyTo(remoteReferencesQuery), args(&groupID, &remoteGroupID, &referenceCount), func() {
+		directory.addReferences(groupID, remoteGroupID, referenceCount)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//count rules referencing CIDRs
+	var ruleCount uint64
+	err = q.scan("ip_prefix_rules", cfg.applyTo(ipPrefixRulesQuery), args(&projectID, &groupID, &ruleCount), func() {
 		if project, exists := result[projectID]; exists {
-			group1, exists1 := project.Groups[groupName1]
-			group2, exists2 := project.Groups[groupName2]
-			if exists1 && exists2 {
-				group1.SharedPortCount[groupName2] = portCount
-				group2.SharedPortCount[groupName1] = portCount
+			if group, exists := project.Groups[groupID]; exists {
+				group.IPPrefixRuleCount = ruleCount
 			}
 		}
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if !cfg.DatabaseSchema.HasAddressGroups {
+		return result, inconsistentRows, nil
 	}
 
-	//find security groups with rules referencing other security groups
+	//find security groups with rules referencing address groups
 	var (
-		remoteGroupName string
-		referenceCount  uint64
+		addressGroupID string
+		addressCount   uint64
 	)
-	err = scan(db, cfg.applyTo(remoteReferencesQuery), args(&projectID, &groupName, &remoteGroupName, &referenceCount), func() {
-		//This is coded defensively, see above.
+	err = q.scan("address_group_references", cfg.applyTo(addressGroupReferencesQuery), args(&projectID, &groupID, &addressGroupID, &ruleCount, &addressCount), func() {
 		if project, exists := result[projectID]; exists {
-			group, exists := project.Groups[groupName]
-			_, remoteExists := project.Groups[remoteGroupName]
-			if exists && remoteExists {
-				group.ReferenceCount[remoteGroupName] = referenceCount
+			if group, exists := project.Groups[groupID]; exists {
+				group.AddressGroupReferences[addressGroupID] = &AddressGroupReference{ruleCount, addressCount}
 			}
 		}
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, inconsistentRows, nil
+}
 
-	return result, err
+//The queries for which CollectData() counts inconsistent result rows.
+var inconsistentRowsQueryNames = []string{"shared_ports", "port_combinations", "host_port_combinations"}
+
+//QueryError is returned by CollectData() when one of its queries fails.
+type QueryError struct {
+	//Identifies the query, e.g. "shared_ports".
+	QueryName string
+	//Whether the query was aborted because it exceeded its deadline (or the
+	//deadline of the whole collection).
+	TimedOut bool
+	Err      error
+}
+
+//Error implements the builtin/error interface.
+func (e QueryError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("query %s timed out: %s", e.QueryName, e.Err.Error())
+	}
+	return fmt.Sprintf("query %s failed: %s", e.QueryName, e.Err.Error())
+}
+
+//queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//queryRunner executes the queries of a single collection.
+type queryRunner struct {
+	ctx context.Context
+	db  queryer
+	//deadline for each query (including reading its results)
+	timeout time.Duration
 }
 
-func scan(db *sql.DB, query string, args []interface{}, action func()) error {
-	rows, err := db.Query(query)
+//Executes the given query, and calls action() for each result row after
+//scanning the row into args. Errors are wrapped in QueryError.
+func (q queryRunner) scan(queryName, query string, args []interface{}, action func()) error {
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	defer cancel()
+
+	err := scanRows(ctx, q.db, query, args, action)
+	if err != nil {
+		//the error returned by the driver does not reliably indicate a timeout
+		return QueryError{queryName, ctx.Err() == context.DeadlineExceeded, err}
+	}
+	return nil
+}
+
+func scanRows(ctx context.Context, db queryer, query string, args []interface{}, action func()) error {
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
+	defer rows.Close() //return the connection to the pool even when Scan() fails
 	for rows.Next() {
 		err := rows.Scan(args...)
 		if err != nil {
@@ -142,10 +543,10 @@ func scan(db *sql.DB, query string, args []interface{}, action func()) error {
 		}
 		action()
 	}
-	return nil
+	return rows.Err()
 }
 
-//Syntactic sugar for scan().
+//Syntactic sugar for queryRunner.scan().
 func args(vals ...interface{}) []interface{} {
 	return vals
 }
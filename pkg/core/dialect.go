@@ -0,0 +1,200 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Dialect abstracts over the differences between the database engines that
+//Neutron can be deployed on.
+type Dialect interface {
+	//Name of the database/sql driver to use. The driver must be registered by
+	//the main program.
+	DriverName() string
+	//Converts the database URI into a data source name understood by the driver.
+	DataSourceName(uri *url.URL) (string, error)
+	//Rewrites a query written in the PostgreSQL dialect (the one used for all
+	//queries in this package) into this dialect.
+	Rebind(query string) string
+	//Returns the connection parameter (key and value for the query string of
+	//the database URI) that limits the runtime of each statement.
+	StatementTimeoutParameter(timeout time.Duration) (string, string)
+}
+
+//DialectForURI selects the Dialect matching the scheme of the given database URI.
+func DialectForURI(uri *url.URL) (Dialect, error) {
+	switch uri.Scheme {
+	case "postgres", "postgresql":
+		return postgresDialect{}, nil
+	case "mysql":
+		return mysqlDialect{}, nil
+	case "mariadb":
+		return mariadbDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database URI scheme: %q", uri.Scheme)
+	}
+}
+
+//OpenDatabase opens a connection pool for the Neutron DB configured in cfg.
+//The pool is meant to be reused across collections.
+func OpenDatabase(cfg Config) (*sql.DB, error) {
+	uri, err := url.Parse(cfg.DatabaseURI)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DatabasePool.StatementTimeout > 0 {
+		key, value := cfg.Dialect.StatementTimeoutParameter(cfg.DatabasePool.StatementTimeout)
+		if uri.Query().Get(key) == "" { //explicit values in the DATABASE_URI take precedence
+			//append instead of re-encoding the query string since go-sql-driver/mysql
+			//does not unescape all parameters
+			if uri.RawQuery != "" {
+				uri.RawQuery += "&"
+			}
+			uri.RawQuery += key + "=" + value
+		}
+	}
+	dsn, err := cfg.Dialect.DataSourceName(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(cfg.Dialect.DriverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.DatabasePool.MaxOpenConnections)
+	db.SetMaxIdleConns(cfg.DatabasePool.MaxIdleConnections)
+	db.SetConnMaxLifetime(cfg.DatabasePool.ConnectionLifetime)
+	return db, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//PostgreSQL
+
+type postgresDialect struct{}
+
+func (postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) DataSourceName(uri *url.URL) (string, error) {
+	//lib/pq understands URIs natively
+	return uri.String(), nil
+}
+
+func (postgresDialect) Rebind(query string) string {
+	return query
+}
+
+func (postgresDialect) StatementTimeoutParameter(timeout time.Duration) (string, string) {
+	//lib/pq sends unknown parameters to the server as runtime parameters
+	return "statement_timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//MySQL/MariaDB
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) DriverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) DataSourceName(uri *url.URL) (string, error) {
+	//go-sql-driver/mysql wants "user:pass@tcp(host:port)/dbname?params"
+	host := uri.Host
+	if host == "" {
+		return "", fmt.Errorf("missing host in database URI")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "3306")
+	}
+
+	var userInfo string
+	if uri.User != nil {
+		userInfo = uri.User.Username()
+		if password, ok := uri.User.Password(); ok {
+			userInfo += ":" + password
+		}
+		userInfo += "@"
+	}
+
+	//GROUP_CONCAT() truncates its result to group_concat_max_len (default: 1024
+	//bytes, i.e. 28 security group UUIDs), which would break the combination
+	//keys of ports with many security groups, so raise the limit (the driver
+	//sends unknown parameters to the server as system variables; the query
+	//string is not re-encoded since the driver does not unescape all
+	//parameters)
+	params := uri.RawQuery
+	if uri.Query().Get("group_concat_max_len") == "" { //explicit values in the DATABASE_URI take precedence
+		if params != "" {
+			params += "&"
+		}
+		params += "group_concat_max_len=" + strconv.Itoa(mysqlGroupConcatMaxLen)
+	}
+
+	dsn := fmt.Sprintf("%stcp(%s)/%s?%s", userInfo, host, strings.TrimPrefix(uri.Path, "/"), params)
+	return dsn, nil
+}
+
+//Enough for combination keys of more than 25000 security groups.
+const mysqlGroupConcatMaxLen = 1 << 20
+
+var (
+	postgresPlaceholderRx = regexp.MustCompile(`\$\d+`)
+	//matches "string_agg(expr, 'separator' ORDER BY expr)"
+	postgresStringAggRx = regexp.MustCompile(`string_agg\(([^,()]+), ('[^']*') ORDER BY ([^()]+)\)`)
+)
+
+func (mysqlDialect) Rebind(query string) string {
+	query = postgresPlaceholderRx.ReplaceAllString(query, "?")
+	query = strings.Replace(query, "current_schema()", "DATABASE()", -1)
+	//NOTE: DataSourceName() raises group_concat_max_len to avoid truncation
+	return postgresStringAggRx.ReplaceAllString(query, "GROUP_CONCAT($1 ORDER BY $3 SEPARATOR $2)")
+}
+
+func (mysqlDialect) StatementTimeoutParameter(timeout time.Duration) (string, string) {
+	//go-sql-driver/mysql sends unknown parameters to the server as system
+	//variables
+	return "max_execution_time", strconv.FormatInt(int64(timeout/time.Millisecond), 10)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//MariaDB
+
+//mariadbDialect is like mysqlDialect, except that MariaDB uses a different
+//system variable for the statement timeout.
+type mariadbDialect struct {
+	mysqlDialect
+}
+
+func (mariadbDialect) StatementTimeoutParameter(timeout time.Duration) (string, string) {
+	//MariaDB does not have `max_execution_time`; `max_statement_time` is in
+	//seconds, but accepts fractional values
+	return "max_statement_time", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+}
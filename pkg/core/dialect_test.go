@@ -0,0 +1,123 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMySQLDataSourceName(t *testing.T) {
+	testCases := map[string]string{
+		"mysql://user:pass@db/neutron":                                   "user:pass@tcp(db:3306)/neutron?group_concat_max_len=1048576",
+		"mysql://db:3307/neutron?charset=utf8mb4,utf8":                   "tcp(db:3307)/neutron?charset=utf8mb4,utf8&group_concat_max_len=1048576",
+		"mariadb://user@db/neutron?group_concat_max_len=4096&timeout=5s": "user@tcp(db:3306)/neutron?group_concat_max_len=4096&timeout=5s",
+	}
+	for uriStr, expected := range testCases {
+		uri, err := url.Parse(uriStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := mysqlDialect{}.DataSourceName(uri)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", uriStr, err.Error())
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%s: expected DSN %q, got %q", uriStr, expected, actual)
+		}
+	}
+}
+
+func TestStatementTimeoutParameter(t *testing.T) {
+	testCases := map[string][2]string{
+		"postgres://db/neutron": {"statement_timeout", "1500"},
+		"mysql://db/neutron":    {"max_execution_time", "1500"},
+		"mariadb://db/neutron":  {"max_statement_time", "1.5"},
+	}
+	for uriStr, expected := range testCases {
+		uri, err := url.Parse(uriStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialect, err := DialectForURI(uri)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", uriStr, err.Error())
+			continue
+		}
+		key, value := dialect.StatementTimeoutParameter(1500 * time.Millisecond)
+		if key != expected[0] || value != expected[1] {
+			t.Errorf("%s: expected parameter %s=%s, got %s=%s", uriStr, expected[0], expected[1], key, value)
+		}
+	}
+}
+
+func TestMySQLRebind(t *testing.T) {
+	//all queries from db.go and schema.go (those with string_agg() need to be
+	//converted into GROUP_CONCAT(), which is only done by a regex, so it must
+	//be checked that the regex still matches when one of these queries changes)
+	queries := map[string]string{
+		"security_groups":          securityGroupsQuery,
+		"shared_ports":             sharedPortsQuery,
+		"port_combinations":        portCombinationsQuery,
+		"host_port_combinations":   fmt.Sprintf(hostPortCombinationsQuery, "AND pb.status = 'ACTIVE'"),
+		"ip_prefix_rules":          ipPrefixRulesQuery,
+		"address_group_references": addressGroupReferencesQuery,
+		"remote_references":        remoteReferencesQuery,
+		"schema_columns":           schemaColumnsQuery,
+	}
+	expectedGroupConcat := "GROUP_CONCAT(security_group_id ORDER BY security_group_id SEPARATOR ',')"
+	leftoverRx := regexp.MustCompile(`(?i)string_agg|\$\d|current_schema`)
+
+	for _, dialect := range []Dialect{mysqlDialect{}, mariadbDialect{}} {
+		for queryName, query := range queries {
+			actual := dialect.Rebind(query)
+			if match := leftoverRx.FindString(actual); match != "" {
+				t.Errorf("%T: %s: %q was not converted in query:%s", dialect, queryName, match, actual)
+			}
+			expectedCount := strings.Count(query, "string_agg(")
+			if actualCount := strings.Count(actual, expectedGroupConcat); actualCount != expectedCount {
+				t.Errorf("%T: %s: expected %d occurrences of %s, got %d in query:%s",
+					dialect, queryName, expectedCount, expectedGroupConcat, actualCount, actual)
+			}
+		}
+	}
+
+	//the aggregations that the scoring relies on must not get lost
+	for _, queryName := range []string{"port_combinations", "host_port_combinations"} {
+		if !strings.Contains(queries[queryName], "string_agg(") {
+			t.Errorf("%s: expected query to use string_agg()", queryName)
+		}
+	}
+	if actual := (mysqlDialect{}).Rebind(schemaColumnsQuery); !strings.Contains(actual, "table_schema = DATABASE()") {
+		t.Errorf("schema_columns: expected current_schema() to be replaced, got query:%s", actual)
+	}
+
+	//placeholders
+	actual := mysqlDialect{}.Rebind("SELECT name FROM securitygroups WHERE id = $1 AND project_id = $2")
+	expected := "SELECT name FROM securitygroups WHERE id = ? AND project_id = ?"
+	if actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,692 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//ChangeKind identifies the type of difference described by a Change.
+type ChangeKind string
+
+const (
+	//GroupAddedChange is a security group that only exists in the newer
+	//project. The change includes its ports, and its shared ports and
+	//references with all groups that were present at that point.
+	GroupAddedChange ChangeKind = "group_added"
+	//GroupRemovedChange is a security group that only exists in the older
+	//project. The change includes its shared ports and references.
+	GroupRemovedChange ChangeKind = "group_removed"
+	//GroupRenamedChange is a security group whose name has changed.
+	GroupRenamedChange ChangeKind = "group_renamed"
+	//PortCountChange is a change in the number of ports in a security group.
+	PortCountChange ChangeKind = "port_count"
+	//SharedPortCountChange is a change in the number of ports that are in both
+	//of two security groups.
+	SharedPortCountChange ChangeKind = "shared_port_count"
+	//PortCombinationChange is a change in the number of ports that are in
+	//exactly a certain set of security groups.
+	PortCombinationChange ChangeKind = "port_combination"
+	//ReferenceCountChange is a change in the number of rules in one security
+	//group that reference another security group.
+	ReferenceCountChange ChangeKind = "reference_count"
+	//IPPrefixRuleCountChange is a change in the number of rules in one
+	//security group that reference a CIDR.
+	IPPrefixRuleCountChange ChangeKind = "ip_prefix_rule_count"
+	//AddressGroupReferenceChange is a change in the number of rules in one
+	//security group that reference an address group.
+	AddressGroupReferenceChange ChangeKind = "address_group_reference"
+	//AddressGroupSizeChange is a change in the number of addresses in an
+	//address group that is referenced by a security group.
+	AddressGroupSizeChange ChangeKind = "address_group_size"
+)
+
+//Change is a single difference between two versions of a project, as
+//reported by Diff().
+type Change struct {
+	Kind                  ChangeKind `json:"kind"`
+	SecurityGroupID       string     `json:"security_group_id,omitempty"`
+	RemoteSecurityGroupID string     `json:"remote_security_group_id,omitempty"`
+	RemoteAddressGroupID  string     `json:"remote_address_group_id,omitempty"`
+	//For port_combination: the UUIDs of all groups in the combination.
+	SecurityGroupIDs []string `json:"security_group_ids,omitempty"`
+	//For group_added/group_removed: the group's port count.
+	//For group_renamed: unused.
+	//For all other kinds: the respective counts before and after.
+	Before      uint64 `json:"before"`
+	After       uint64 `json:"after"`
+	Description string `json:"description"`
+	//How much this change contributed to the difference in the project's
+	//maximum and total score.
+	MaxScoreDelta   int64 `json:"max_score_delta"`
+	TotalScoreDelta int64 `json:"total_score_delta"`
+}
+
+//ProjectDiff describes the differences between two versions of a project.
+type ProjectDiff struct {
+	ProjectID        string   `json:"project_id"`
+	MaxScoreBefore   uint64   `json:"max_score_before"`
+	MaxScoreAfter    uint64   `json:"max_score_after"`
+	TotalScoreBefore uint64   `json:"total_score_before"`
+	TotalScoreAfter  uint64   `json:"total_score_after"`
+	Changes          []Change `json:"changes"`
+}
+
+//Diff computes the differences between two versions of a project (either one
+//may be nil if the project only exists in the other version).
+//
+//To attribute the score delta to the individual changes, the changes are
+//applied to the older version one after another, and each change is
+//attributed with the score delta caused by applying it. The changes are
+//applied in the following order: removed groups, added groups, renamed
+//groups, port counts, shared port counts, port combinations, references,
+//rules referencing CIDRs or address groups (in order of group UUIDs within
+//each step). Because the score is not linear, the attribution depends on
+//this order, but the deltas of all changes always add up to the total delta.
+//
+//Only the project itself is considered, i.e. edges to security groups in
+//other projects (see SecurityGroup.ForeignReferenceCount etc.) are ignored.
+//
+//Since each change can only affect the partitions containing its groups,
+//only these partitions are scored again after each change.
+func Diff(before, after *Project) ProjectDiff {
+	if before == nil {
+		before = &Project{UUID: after.UUID, Groups: make(map[string]*SecurityGroup)}
+	}
+	if after == nil {
+		after = &Project{UUID: before.UUID, Groups: make(map[string]*SecurityGroup)}
+	}
+
+	d := differ{
+		current:               before.Clone(),
+		after:                 after,
+		referencingGroupIDs:   make(map[string][]string),
+		partitions:            make(map[int]PartitionReport),
+		partitionKeyByGroupID: make(map[string]int),
+		result: ProjectDiff{
+			ProjectID: after.UUID,
+			Changes:   []Change{},
+		},
+	}
+	for groupID, group := range after.Groups {
+		for otherGroupID := range group.ReferenceCount {
+			d.referencingGroupIDs[otherGroupID] = append(d.referencingGroupIDs[otherGroupID], groupID)
+		}
+	}
+	for _, partition := range d.current.PartitionSecurityGroups() {
+		score := d.addPartition(partition)
+		d.totalScore += score
+		if d.maxScore < score {
+			d.maxScore = score
+		}
+	}
+	d.result.MaxScoreBefore, d.result.TotalScoreBefore = d.maxScore, d.totalScore
+
+	beforeIDs := Partition(before.Groups).SortedGroupIDs()
+	afterIDs := Partition(after.Groups).SortedGroupIDs()
+
+	for _, groupID := range beforeIDs {
+		if _, exists := after.Groups[groupID]; !exists {
+			d.removeGroup(groupID)
+		}
+	}
+	for _, groupID := range afterIDs {
+		if _, exists := before.Groups[groupID]; !exists {
+			d.addGroup(groupID)
+		}
+	}
+	for _, groupID := range afterIDs {
+		d.renameGroup(groupID)
+	}
+	for _, groupID := range afterIDs {
+		d.setPortCount(groupID)
+	}
+	for _, groupID := range afterIDs {
+		for _, otherGroupID := range d.otherGroupIDs(groupID, sharedPortCountOf) {
+			if groupID < otherGroupID {
+				d.setSharedPortCount(groupID, otherGroupID)
+			}
+		}
+	}
+	for _, key := range d.combinationKeys() {
+		d.setCombinationPortCount(key)
+	}
+	for _, groupID := range afterIDs {
+		for _, otherGroupID := range d.otherGroupIDs(groupID, referenceCountOf) {
+			d.setReferenceCount(groupID, otherGroupID)
+		}
+	}
+	for _, groupID := range afterIDs {
+		d.setIPPrefixRuleCount(groupID)
+	}
+	for _, groupID := range afterIDs {
+		for _, addressGroupID := range d.addressGroupIDs(groupID) {
+			d.setAddressGroupReference(groupID, addressGroupID)
+		}
+	}
+
+	d.result.MaxScoreAfter, d.result.TotalScoreAfter = d.maxScore, d.totalScore
+	return d.result
+}
+
+//Holds the state of Diff() while changes are applied one after another.
+type differ struct {
+	current *Project
+	after   *Project
+	//key = group UUID, value = UUIDs of the groups in d.after with rules
+	//referencing that group
+	referencingGroupIDs map[string][]string
+	//the partitions of d.current (keys are assigned by addPartition)
+	partitions            map[int]PartitionReport
+	partitionKeyByGroupID map[string]int
+	nextPartitionKey      int
+	maxScore              uint64
+	totalScore            uint64
+	//state of the change that is being applied (see beginChange)
+	change pendingChange
+	result ProjectDiff
+}
+
+//pendingChange describes the partitions that are affected by the change that
+//is being applied by a differ.
+type pendingChange struct {
+	mode               repartitionMode
+	affectedPartitions []Partition
+	//for splitPartitions: groups that are not in any of affectedPartitions yet
+	addedGroupIDs   []string
+	removedScore    uint64
+	removedMaxScore bool
+}
+
+//repartitionMode describes how a change affects the partitions containing
+//its groups.
+type repartitionMode int
+
+const (
+	//The change does not add or remove edges between groups.
+	keepPartitions repartitionMode = iota
+	//The change only adds edges between the given groups, so that their
+	//partitions are merged into one.
+	mergePartitions
+	//The change adds or removes groups, or removes edges between groups, so
+	//that the affected partitions need to be computed again.
+	splitPartitions
+)
+
+//Adds a partition of d.current to d.partitions, and returns its score.
+func (d *differ) addPartition(partition Partition) uint64 {
+	part := PartitionReport{partition, partition.Score()}
+	key := d.nextPartitionKey
+	d.nextPartitionKey++
+	d.partitions[key] = part
+	for groupID := range partition {
+		d.partitionKeyByGroupID[groupID] = key
+	}
+	return part.Score.Value
+}
+
+//Must be called before a change is applied to d.current. The partitions
+//containing the given groups are removed from d.partitions, and will be
+//scored again by record().
+func (d *differ) beginChange(mode repartitionMode, groupIDs ...string) {
+	d.change = pendingChange{mode: mode}
+	for _, groupID := range groupIDs {
+		key, exists := d.partitionKeyByGroupID[groupID]
+		if !exists {
+			if _, exists := d.current.Groups[groupID]; !exists {
+				d.change.addedGroupIDs = append(d.change.addedGroupIDs, groupID)
+			}
+			continue //otherwise, this group's partition was already removed
+		}
+		part := d.partitions[key]
+		delete(d.partitions, key)
+		for memberID := range part.Partition {
+			delete(d.partitionKeyByGroupID, memberID)
+		}
+		d.change.affectedPartitions = append(d.change.affectedPartitions, part.Partition)
+		d.change.removedScore += part.Score.Value
+		if part.Score.Value == d.maxScore {
+			d.change.removedMaxScore = true
+		}
+	}
+}
+
+//Records a change that has been applied to d.current.
+func (d *differ) record(c Change) {
+	maxScore, totalScore := d.maxScore, d.totalScore-d.change.removedScore
+	if d.change.removedMaxScore {
+		maxScore = 0
+		for _, part := range d.partitions {
+			if maxScore < part.Score.Value {
+				maxScore = part.Score.Value
+			}
+		}
+	}
+
+	partitions := d.change.affectedPartitions
+	switch d.change.mode {
+	case mergePartitions:
+		if len(partitions) > 1 {
+			merged := make(Partition)
+			for _, partition := range partitions {
+				for groupID, group := range partition {
+					merged[groupID] = group
+				}
+			}
+			partitions = []Partition{merged}
+		}
+	case splitPartitions:
+		affected := Project{Groups: make(map[string]*SecurityGroup)}
+		for _, partition := range partitions {
+			for groupID := range partition {
+				if group, exists := d.current.Groups[groupID]; exists {
+					affected.Groups[groupID] = group
+				}
+			}
+		}
+		for _, groupID := range d.change.addedGroupIDs {
+			if group, exists := d.current.Groups[groupID]; exists {
+				affected.Groups[groupID] = group
+			}
+		}
+		partitions = affected.PartitionSecurityGroups()
+	}
+	for _, partition := range partitions {
+		score := d.addPartition(partition)
+		totalScore += score
+		if maxScore < score {
+			maxScore = score
+		}
+	}
+	d.change = pendingChange{}
+
+	c.MaxScoreDelta = int64(maxScore) - int64(d.maxScore)
+	c.TotalScoreDelta = int64(totalScore) - int64(d.totalScore)
+	d.maxScore, d.totalScore = maxScore, totalScore
+	d.result.Changes = append(d.result.Changes, c)
+}
+
+//Returns the repartitionMode for a change that sets the count of an edge
+//between two groups to the given value.
+func edgeRepartitionMode(count uint64) repartitionMode {
+	if count == 0 {
+		return splitPartitions
+	}
+	return mergePartitions
+}
+
+func (d *differ) removeGroup(groupID string) {
+	group := d.current.Groups[groupID]
+	d.beginChange(splitPartitions, groupID)
+	d.current.deleteGroup(groupID)
+	d.record(Change{
+		Kind:            GroupRemovedChange,
+		SecurityGroupID: groupID,
+		Before:          group.PortCount,
+		Description:     fmt.Sprintf("security group %s with %d ports was removed", group, group.PortCount),
+	})
+}
+
+func (d *differ) addGroup(groupID string) {
+	source := d.after.Groups[groupID]
+
+	//connect to all groups that are already there (connections to groups that
+	//are added later will be established when those are added)
+	isOtherGroupID := make(map[string]bool)
+	for otherGroupID := range source.SharedPortCount {
+		isOtherGroupID[otherGroupID] = true
+	}
+	for otherGroupID := range source.ReferenceCount {
+		isOtherGroupID[otherGroupID] = true
+	}
+	for _, otherGroupID := range d.referencingGroupIDs[groupID] {
+		isOtherGroupID[otherGroupID] = true
+	}
+	otherGroupIDs := make([]string, 0, len(isOtherGroupID))
+	for otherGroupID := range isOtherGroupID {
+		if _, exists := d.current.Groups[otherGroupID]; exists && otherGroupID != groupID {
+			otherGroupIDs = append(otherGroupIDs, otherGroupID)
+		}
+	}
+	d.beginChange(splitPartitions, append(otherGroupIDs, groupID)...)
+
+	group := newSecurityGroup(groupID, source.Name, source.PortCount)
+	group.IPPrefixRuleCount = source.IPPrefixRuleCount
+	for addressGroupID, ref := range source.AddressGroupReferences {
+		clone := *ref
+		group.AddressGroupReferences[addressGroupID] = &clone
+	}
+	d.current.Groups[groupID] = group
+	for key, portCount := range source.PortCombinations {
+		d.current.setCombinationPortCount(key, portCount) //if all groups are present
+	}
+
+	for _, otherGroupID := range otherGroupIDs {
+		otherGroup := d.current.Groups[otherGroupID]
+		if count := source.SharedPortCount[otherGroupID]; count > 0 {
+			group.SharedPortCount[otherGroupID] = count
+			otherGroup.SharedPortCount[groupID] = count
+		}
+		if count := source.ReferenceCount[otherGroupID]; count > 0 {
+			group.ReferenceCount[otherGroupID] = count
+		}
+		if count := d.after.Groups[otherGroupID].ReferenceCount[groupID]; count > 0 {
+			otherGroup.ReferenceCount[groupID] = count
+		}
+	}
+
+	d.record(Change{
+		Kind:            GroupAddedChange,
+		SecurityGroupID: groupID,
+		After:           group.PortCount,
+		Description:     fmt.Sprintf("security group %s with %d ports was added", group, group.PortCount),
+	})
+}
+
+func (d *differ) renameGroup(groupID string) {
+	group := d.current.Groups[groupID]
+	newName := d.after.Groups[groupID].Name
+	if group.Name == newName {
+		return
+	}
+	oldName := group.Name
+	group.Name = newName
+	d.record(Change{
+		Kind:            GroupRenamedChange,
+		SecurityGroupID: groupID,
+		Description:     fmt.Sprintf("security group %s was renamed from %q", group, oldName),
+	})
+}
+
+func (d *differ) setPortCount(groupID string) {
+	group := d.current.Groups[groupID]
+	before, after := group.PortCount, d.after.Groups[groupID].PortCount
+	if before == after {
+		return
+	}
+	d.beginChange(keepPartitions, groupID)
+	group.PortCount = after
+	d.record(Change{
+		Kind:            PortCountChange,
+		SecurityGroupID: groupID,
+		Before:          before,
+		After:           after,
+		Description:     fmt.Sprintf("number of ports in security group %s changed from %d to %d", group, before, after),
+	})
+}
+
+func (d *differ) setSharedPortCount(groupID, otherGroupID string) {
+	group, otherGroup := d.current.Groups[groupID], d.current.Groups[otherGroupID]
+	before, after := group.SharedPortCount[otherGroupID], d.after.Groups[groupID].SharedPortCount[otherGroupID]
+	if before == after {
+		return
+	}
+	d.beginChange(edgeRepartitionMode(after), groupID, otherGroupID)
+	if after == 0 {
+		delete(group.SharedPortCount, otherGroupID)
+		delete(otherGroup.SharedPortCount, groupID)
+	} else {
+		group.SharedPortCount[otherGroupID] = after
+		otherGroup.SharedPortCount[groupID] = after
+	}
+	d.record(Change{
+		Kind:                  SharedPortCountChange,
+		SecurityGroupID:       groupID,
+		RemoteSecurityGroupID: otherGroupID,
+		Before:                before,
+		After:                 after,
+		Description: fmt.Sprintf(
+			"number of ports in both security groups %s and %s changed from %d to %d",
+			group, otherGroup, before, after,
+		),
+	})
+}
+
+func sharedPortCountOf(group *SecurityGroup) map[string]uint64 {
+	return group.SharedPortCount
+}
+
+func referenceCountOf(group *SecurityGroup) map[string]uint64 {
+	return group.ReferenceCount
+}
+
+//Returns the UUIDs of all groups (in sorted order) that appear in the given
+//map of the given group in d.current or d.after, and that exist in d.after.
+func (d *differ) otherGroupIDs(groupID string, countsOf func(*SecurityGroup) map[string]uint64) []string {
+	isID := make(map[string]bool)
+	for otherGroupID := range countsOf(d.current.Groups[groupID]) {
+		isID[otherGroupID] = true
+	}
+	for otherGroupID := range countsOf(d.after.Groups[groupID]) {
+		isID[otherGroupID] = true
+	}
+	ids := make([]string, 0, len(isID))
+	for id := range isID {
+		if _, exists := d.after.Groups[id]; exists {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Returns the keys of all port combinations in d.current and d.after (in
+//sorted order).
+func (d *differ) combinationKeys() []string {
+	isKey := make(map[string]bool)
+	for _, p := range []*Project{d.current, d.after} {
+		for _, group := range p.Groups {
+			for key := range group.PortCombinations {
+				isKey[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(isKey))
+	for key := range isKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *differ) setCombinationPortCount(key string) {
+	groupIDs := CombinationGroupIDs(key)
+	var before, after uint64
+	if group, exists := d.current.Groups[groupIDs[0]]; exists {
+		before = group.PortCombinations[key]
+	}
+	if group, exists := d.after.Groups[groupIDs[0]]; exists {
+		after = group.PortCombinations[key]
+	}
+	if before == after {
+		return
+	}
+	d.beginChange(keepPartitions, groupIDs...)
+	d.current.setCombinationPortCount(key, after)
+
+	names := make([]string, len(groupIDs))
+	for idx, groupID := range groupIDs {
+		names[idx] = d.current.Groups[groupID].String()
+	}
+	d.record(Change{
+		Kind:             PortCombinationChange,
+		SecurityGroupIDs: groupIDs,
+		Before:           before,
+		After:            after,
+		Description: fmt.Sprintf(
+			"number of ports in exactly the security groups %s changed from %d to %d",
+			strings.Join(names, ", "), before, after,
+		),
+	})
+}
+
+func (d *differ) setReferenceCount(groupID, otherGroupID string) {
+	group, otherGroup := d.current.Groups[groupID], d.current.Groups[otherGroupID]
+	before, after := group.ReferenceCount[otherGroupID], d.after.Groups[groupID].ReferenceCount[otherGroupID]
+	if before == after {
+		return
+	}
+	d.beginChange(edgeRepartitionMode(after), groupID, otherGroupID)
+	if after == 0 {
+		delete(group.ReferenceCount, otherGroupID)
+	} else {
+		group.ReferenceCount[otherGroupID] = after
+	}
+	d.record(Change{
+		Kind:                  ReferenceCountChange,
+		SecurityGroupID:       groupID,
+		RemoteSecurityGroupID: otherGroupID,
+		Before:                before,
+		After:                 after,
+		Description: fmt.Sprintf(
+			"number of rules in security group %s referencing security group %s changed from %d to %d",
+			group, otherGroup, before, after,
+		),
+	})
+}
+
+func (d *differ) setIPPrefixRuleCount(groupID string) {
+	group := d.current.Groups[groupID]
+	before, after := group.IPPrefixRuleCount, d.after.Groups[groupID].IPPrefixRuleCount
+	if before == after {
+		return
+	}
+	d.beginChange(keepPartitions, groupID)
+	group.IPPrefixRuleCount = after
+	d.record(Change{
+		Kind:            IPPrefixRuleCountChange,
+		SecurityGroupID: groupID,
+		Before:          before,
+		After:           after,
+		Description: fmt.Sprintf(
+			"number of rules in security group %s referencing CIDRs changed from %d to %d",
+			group, before, after,
+		),
+	})
+}
+
+//Returns the UUIDs of all address groups referenced by the given security
+//group in d.current or d.after (in sorted order).
+func (d *differ) addressGroupIDs(groupID string) []string {
+	isID := make(map[string]bool)
+	for addressGroupID := range d.current.Groups[groupID].AddressGroupReferences {
+		isID[addressGroupID] = true
+	}
+	for addressGroupID := range d.after.Groups[groupID].AddressGroupReferences {
+		isID[addressGroupID] = true
+	}
+	ids := make([]string, 0, len(isID))
+	for id := range isID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (d *differ) setAddressGroupReference(groupID, addressGroupID string) {
+	group := d.current.Groups[groupID]
+	var before, after AddressGroupReference
+	if ref := group.AddressGroupReferences[addressGroupID]; ref != nil {
+		before = *ref
+	}
+	if ref := d.after.Groups[groupID].AddressGroupReferences[addressGroupID]; ref != nil {
+		after = *ref
+	}
+
+	//the address count is only relevant if there are rules
+	if before.RuleCount > 0 && after.RuleCount > 0 && before.AddressCount != after.AddressCount {
+		d.beginChange(keepPartitions, groupID)
+		group.AddressGroupReferences[addressGroupID].AddressCount = after.AddressCount
+		d.record(Change{
+			Kind:                 AddressGroupSizeChange,
+			SecurityGroupID:      groupID,
+			RemoteAddressGroupID: addressGroupID,
+			Before:               before.AddressCount,
+			After:                after.AddressCount,
+			Description: fmt.Sprintf(
+				"number of addresses in address group %s (referenced by security group %s) changed from %d to %d",
+				addressGroupID, group, before.AddressCount, after.AddressCount,
+			),
+		})
+	}
+
+	if before.RuleCount != after.RuleCount {
+		d.beginChange(keepPartitions, groupID)
+		if after.RuleCount == 0 {
+			delete(group.AddressGroupReferences, addressGroupID)
+		} else {
+			ref := after
+			group.AddressGroupReferences[addressGroupID] = &ref
+		}
+		d.record(Change{
+			Kind:                 AddressGroupReferenceChange,
+			SecurityGroupID:      groupID,
+			RemoteAddressGroupID: addressGroupID,
+			Before:               before.RuleCount,
+			After:                after.RuleCount,
+			Description: fmt.Sprintf(
+				"number of rules in security group %s referencing address group %s changed from %d to %d",
+				group, addressGroupID, before.RuleCount, after.RuleCount,
+			),
+		})
+	}
+}
+
+//SortedChanges returns the changes of this diff sorted descending by their
+//contribution to the maximum score (and then to the total score).
+func (d ProjectDiff) SortedChanges() []Change {
+	result := append([]Change(nil), d.Changes...)
+	sort.SliceStable(result, func(i, j int) bool {
+		ci, cj := result[i], result[j]
+		if ci.MaxScoreDelta != cj.MaxScoreDelta {
+			return ci.MaxScoreDelta > cj.MaxScoreDelta
+		}
+		return ci.TotalScoreDelta > cj.TotalScoreDelta
+	})
+	return result
+}
+
+//LogDiff produces a log message for the given diff, listing the changes that
+//contributed the most to the growth of the maximum score.
+func (d ProjectDiff) LogDiff() {
+	reasons := make([]string, 0, 3)
+	for _, c := range d.SortedChanges() {
+		if c.MaxScoreDelta <= 0 && c.TotalScoreDelta <= 0 {
+			break
+		}
+		reasons = append(reasons, fmt.Sprintf("%s (%+d)", c.Description, c.MaxScoreDelta))
+		if len(reasons) == 3 {
+			break
+		}
+	}
+
+	util.LogInfo(
+		"maximum entanglement of project %s grew from %d to %d; top %d reasons: %s",
+		d.ProjectID,
+		d.MaxScoreBefore,
+		d.MaxScoreAfter,
+		len(reasons),
+		strings.Join(reasons, ", "),
+	)
+}
@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func checkDiff(t *testing.T, actual, expected ProjectDiff) {
+	t.Helper()
+	for idx := range actual.Changes {
+		if actual.Changes[idx].Description == "" {
+			t.Errorf("change %d has no description", idx)
+		}
+		actual.Changes[idx].Description = ""
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		actualJSON, _ := json.Marshal(actual)
+		expectedJSON, _ := json.Marshal(expected)
+		t.Errorf("expected diff\n\t%s\ngot\n\t%s", expectedJSON, actualJSON)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := exampleProject()
+	after := exampleProject()
+	//a new monitoring group referencing the default group
+	after.Groups["mon"] = newSecurityGroup("mon", "mon-name", 1)
+	after.Groups["mon"].ReferenceCount["default"] = 1
+	//the jump servers' group was renamed
+	after.Groups["jump"].Name = "jump-renamed"
+	//two new app servers
+	after.addPorts([]string{"app", "default"}, 2)
+	//the database group does not reference the app servers anymore
+	delete(after.Groups["db"].ReferenceCount, "app")
+
+	//the changes are applied in a fixed order, e.g. port counts are changed
+	//before the rule referencing the app servers is removed, so the rule is
+	//attributed with the removal of all 12 ports
+	checkDiff(t, Diff(before, after), ProjectDiff{
+		ProjectID:        "example",
+		MaxScoreBefore:   14,
+		MaxScoreAfter:    17,
+		TotalScoreBefore: 14,
+		TotalScoreAfter:  17,
+		Changes: []Change{
+			{Kind: GroupAddedChange, SecurityGroupID: "mon", After: 1, MaxScoreDelta: 11, TotalScoreDelta: 11},
+			{Kind: GroupRenamedChange, SecurityGroupID: "jump"},
+			{Kind: PortCountChange, SecurityGroupID: "app", Before: 10, After: 12, MaxScoreDelta: 2, TotalScoreDelta: 2},
+			{Kind: PortCountChange, SecurityGroupID: "default", Before: 11, After: 13, MaxScoreDelta: 2, TotalScoreDelta: 2},
+			{Kind: SharedPortCountChange, SecurityGroupID: "app", RemoteSecurityGroupID: "default", Before: 10, After: 12},
+			{Kind: PortCombinationChange, SecurityGroupIDs: []string{"app", "default"}, Before: 10, After: 12},
+			{Kind: ReferenceCountChange, SecurityGroupID: "db", RemoteSecurityGroupID: "app", Before: 1, After: 0, MaxScoreDelta: -12, TotalScoreDelta: -12},
+		},
+	})
+}
+
+func TestDiffWithSplitPartition(t *testing.T) {
+	before := exampleProject()
+	after := exampleProject()
+	after.deleteGroup("default")
+
+	//without the default group, the jump servers are in a separate partition,
+	//so the maximum score drops by 4 (the 2 shared pairs and the 2 jump servers
+	//behind the rule in the default group)
+	checkDiff(t, Diff(before, after), ProjectDiff{
+		ProjectID:        "example",
+		MaxScoreBefore:   14,
+		MaxScoreAfter:    10,
+		TotalScoreBefore: 14,
+		TotalScoreAfter:  10,
+		Changes: []Change{
+			{Kind: GroupRemovedChange, SecurityGroupID: "default", Before: 11, MaxScoreDelta: -4, TotalScoreDelta: -4},
+		},
+	})
+
+	//the other way around, the partitions are merged again
+	checkDiff(t, Diff(after, before), ProjectDiff{
+		ProjectID:        "example",
+		MaxScoreBefore:   10,
+		MaxScoreAfter:    14,
+		TotalScoreBefore: 10,
+		TotalScoreAfter:  14,
+		Changes: []Change{
+			{Kind: GroupAddedChange, SecurityGroupID: "default", After: 11, MaxScoreDelta: 4, TotalScoreDelta: 4},
+		},
+	})
+}
+
+func TestDiffWithMissingProject(t *testing.T) {
+	diff := Diff(nil, exampleProject())
+	if diff.MaxScoreBefore != 0 || diff.MaxScoreAfter != 14 {
+		t.Errorf("expected maximum score to grow from 0 to 14, got %d to %d", diff.MaxScoreBefore, diff.MaxScoreAfter)
+	}
+
+	diff = Diff(exampleProject(), nil)
+	if diff.MaxScoreBefore != 14 || diff.MaxScoreAfter != 0 {
+		t.Errorf("expected maximum score to drop from 14 to 0, got %d to %d", diff.MaxScoreBefore, diff.MaxScoreAfter)
+	}
+	var totalScoreDelta int64
+	for _, c := range diff.Changes {
+		if c.Kind != GroupRemovedChange {
+			t.Errorf("expected only removed groups, got %#v", c)
+		}
+		totalScoreDelta += c.TotalScoreDelta
+	}
+	if len(diff.Changes) != 4 || totalScoreDelta != -14 {
+		t.Errorf("expected 4 removed groups with a total score delta of -14, got %d with %d", len(diff.Changes), totalScoreDelta)
+	}
+}
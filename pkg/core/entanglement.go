@@ -20,6 +20,8 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"sort"
 	"strings"
@@ -29,64 +31,229 @@ import (
 
 //Partition is a set of interconnected security groups (all groups form a
 //connected graph either via remote references in a security group rule, or by
-//ports that are in multiple security groups). The map key is the group's name.
+//ports that are in multiple security groups). The map key is the group's UUID.
 type Partition map[string]*SecurityGroup
 
+//FactorKind identifies the type of topology aspect that a Factor describes.
+type FactorKind string
+
+const (
+	//SharedPortsFactor counts the pairs of security groups that are shared by ports.
+	SharedPortsFactor FactorKind = "shared_ports"
+	//PortCombinationsFactor counts the distinct sets of two or more security
+	//groups that ports are in (the DVS creates one port group for each such set).
+	PortCombinationsFactor FactorKind = "port_combinations"
+	//RemoteReferenceFactor is the cost of rules in one security group that
+	//reference another security group.
+	RemoteReferenceFactor FactorKind = "remote_reference"
+	//IPPrefixRulesFactor counts the rules in one security group that reference
+	//a CIDR.
+	IPPrefixRulesFactor FactorKind = "ip_prefix_rules"
+	//AddressGroupReferenceFactor counts the rules in one security group that
+	//reference an address group.
+	AddressGroupReferenceFactor FactorKind = "address_group_reference"
+)
+
+//AllFactorKinds lists all possible values of type FactorKind.
+var AllFactorKinds = []FactorKind{
+	SharedPortsFactor, PortCombinationsFactor, RemoteReferenceFactor,
+	IPPrefixRulesFactor, AddressGroupReferenceFactor,
+}
+
 //Factor is an aspect of a Partition's topology that contributes to its
 //entanglement score.
 type Factor struct {
-	Value  uint64
-	Reason string
+	Kind   FactorKind `json:"kind"`
+	Value  uint64     `json:"value"`
+	Reason string     `json:"reason"`
+	//For RemoteReferenceFactor, IPPrefixRulesFactor and
+	//AddressGroupReferenceFactor: the UUID of the group containing the rules.
+	SecurityGroupID string `json:"security_group_id,omitempty"`
+	//For RemoteReferenceFactor: the UUID of the group referenced by the rules.
+	RemoteSecurityGroupID string `json:"remote_security_group_id,omitempty"`
+	//For AddressGroupReferenceFactor: the UUID of the address group referenced
+	//by the rules.
+	RemoteAddressGroupID string `json:"remote_address_group_id,omitempty"`
 }
 
 //Score is the entanglement score of a partition.
 type Score struct {
-	Value   uint64
-	Factors []Factor
+	Value   uint64   `json:"value"`
+	Factors []Factor `json:"factors"`
 }
 
 //PartitionSecurityGroups separate the security groups in this project into
-//Partitions.
+//Partitions. Edges to security groups in other projects are ignored (see
+//PartitionAllSecurityGroups). The partitions are ordered by the smallest UUID
+//among their member groups.
 func (p Project) PartitionSecurityGroups() (result []Partition) {
-	partitioned := make(map[string]bool)
-	for {
-		partition := make(map[string]*SecurityGroup)
-
-		//when adding a group to the partition, also add all connected groups
-		var addRecursively func(string)
-		addRecursively = func(groupName string) {
-			group := p.Groups[groupName]
-			partition[groupName] = group
-			partitioned[groupName] = true //do not consider this group for future partitions
-
-			for _, otherGroup := range p.Groups {
-				if group.SharedPortCount[otherGroup.Name] > 0 || group.ReferenceCount[otherGroup.Name] > 0 {
-					if !partitioned[otherGroup.Name] {
-						addRecursively(otherGroup.Name)
-					}
+	//references are directed, but connect both groups regardless of direction
+	neighbors := make(map[string][]string, len(p.Groups))
+	connect := func(groupID, otherGroupID string, count uint64) {
+		if _, exists := p.Groups[otherGroupID]; exists && count > 0 && groupID != otherGroupID {
+			neighbors[groupID] = append(neighbors[groupID], otherGroupID)
+			neighbors[otherGroupID] = append(neighbors[otherGroupID], groupID)
+		}
+	}
+	groupIDs := make([]string, 0, len(p.Groups))
+	for groupID, group := range p.Groups {
+		groupIDs = append(groupIDs, groupID)
+		for _, counts := range []map[string]uint64{
+			group.SharedPortCount, group.ForeignSharedPortCount,
+			group.ReferenceCount, group.ForeignReferenceCount,
+		} {
+			for otherGroupID, count := range counts {
+				connect(groupID, otherGroupID, count)
+			}
+		}
+	}
+	sort.Strings(groupIDs)
+
+	//traverse the graph depth-first, using an explicit stack instead of
+	//recursion since large projects have very deep partitions
+	partitioned := make(map[string]bool, len(p.Groups))
+	var stack []string
+	for _, startGroupID := range groupIDs {
+		if partitioned[startGroupID] {
+			continue
+		}
+		partition := make(Partition)
+		partitioned[startGroupID] = true //do not consider this group for future partitions
+		stack = append(stack[:0], startGroupID)
+
+		for len(stack) > 0 {
+			groupID := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			partition[groupID] = p.Groups[groupID]
+
+			//when adding a group to the partition, also add all connected groups
+			for _, otherGroupID := range neighbors[groupID] {
+				if !partitioned[otherGroupID] {
+					partitioned[otherGroupID] = true
+					stack = append(stack, otherGroupID)
 				}
 			}
 		}
 
-		//pick a security group at random to start this partition
-		for groupName := range p.Groups {
-			if !partitioned[groupName] {
-				addRecursively(groupName)
-				break
+		result = append(result, partition)
+	}
+	return result
+}
+
+//PartitionAllSecurityGroups is like Project.PartitionSecurityGroups, but also
+//follows the edges between security groups in different projects, so the
+//resulting partitions may span multiple projects. The partitions are ordered
+//by project UUID, then by the smallest UUID among their member groups.
+func PartitionAllSecurityGroups(projects map[string]*Project) []Partition {
+	projectIDs := make([]string, 0, len(projects))
+	for projectID := range projects {
+		projectIDs = append(projectIDs, projectID)
+	}
+	sort.Strings(projectIDs)
+
+	//partition each project separately, then merge partitions that are
+	//connected across projects (there are usually only few such edges)
+	var partitions []Partition
+	partitionIndexByGroupID := make(map[string]int)
+	for _, projectID := range projectIDs {
+		for _, partition := range projects[projectID].PartitionSecurityGroups() {
+			for groupID := range partition {
+				partitionIndexByGroupID[groupID] = len(partitions)
 			}
+			partitions = append(partitions, partition)
 		}
+	}
 
-		if len(partition) > 0 {
-			result = append(result, partition)
+	//union-find over partition indexes; the root of each set is its smallest
+	//index, so that the merged partitions keep the order described above
+	parents := make([]int, len(partitions))
+	for idx := range parents {
+		parents[idx] = idx
+	}
+	find := func(idx int) int {
+		for parents[idx] != idx {
+			parents[idx] = parents[parents[idx]] //path halving
+			idx = parents[idx]
+		}
+		return idx
+	}
+	union := func(groupID, otherGroupID string) {
+		otherIdx, exists := partitionIndexByGroupID[otherGroupID]
+		if !exists {
+			return
+		}
+		rootIdx, otherRootIdx := find(partitionIndexByGroupID[groupID]), find(otherIdx)
+		if rootIdx < otherRootIdx {
+			parents[otherRootIdx] = rootIdx
 		} else {
-			//no more security groups left to partition
-			return result
+			parents[rootIdx] = otherRootIdx
+		}
+	}
+	for _, partition := range partitions {
+		for groupID, group := range partition {
+			//each port combination implies shared ports between its groups, so
+			//ForeignPortCombinations does not need to be considered here
+			for otherGroupID, count := range group.ForeignSharedPortCount {
+				if count > 0 {
+					union(groupID, otherGroupID)
+				}
+			}
+			for otherGroupID, count := range group.ForeignReferenceCount {
+				if count > 0 {
+					union(groupID, otherGroupID)
+				}
+			}
+		}
+	}
+
+	var result []Partition
+	for idx, partition := range partitions {
+		rootIdx := find(idx)
+		if rootIdx == idx {
+			result = append(result, partition)
+			continue
 		}
+		for groupID, group := range partition {
+			partitions[rootIdx][groupID] = group
+		}
+	}
+	return result
+}
+
+//ID returns an identifier for this partition that is derived from the UUIDs
+//of its member groups, so it remains stable across collections as long as
+//the partition's membership does not change.
+func (groups Partition) ID() string {
+	hash := sha256.New()
+	for _, groupID := range groups.SortedGroupIDs() {
+		hash.Write([]byte(groupID + "\n"))
 	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
 }
 
-//Score returns this partition's entanglement score.
-func (groups Partition) Score() (result Score) {
+//SortedGroupIDs returns the UUIDs of all groups in this partition in sorted order.
+func (groups Partition) SortedGroupIDs() []string {
+	ids := make([]string, 0, len(groups))
+	for groupID := range groups {
+		ids = append(ids, groupID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Score returns this partition's entanglement score, as computed by the
+//active scoring model (see UseScorer).
+func (groups Partition) Score() Score {
+	return activeScorer.Score(groups)
+}
+
+//BaseFactors returns the factors contributing to this partition's
+//entanglement score before any weighting: 1 per pair of groups shared by
+//ports, 1 per distinct combination of groups on ports,
+//`PortCount * ReferenceCount` per remote reference, and 1 per rule
+//referencing a CIDR or an address group. Edges to security groups that are
+//not in this partition are ignored.
+func (groups Partition) BaseFactors() (result []Factor) {
 	sharedGroupCount := uint64(0)
 	for _, group := range groups {
 		for _, portCount := range group.SharedPortCount {
@@ -94,11 +261,17 @@ func (groups Partition) Score() (result Score) {
 				sharedGroupCount++
 			}
 		}
+		for otherGroupID, portCount := range group.ForeignSharedPortCount {
+			if portCount > 0 && groups[otherGroupID] != nil {
+				sharedGroupCount++
+			}
+		}
 	}
-	//we double-counted because groups["X"].SharedPortCount["Y"] == groups["Y"].SharedPortCount["X"]
+	//we double-counted because groups[X].SharedPortCount[Y] == groups[Y].SharedPortCount[X]
 	sharedGroupCount /= 2
 	if sharedGroupCount > 0 {
-		result.Factors = append(result.Factors, Factor{
+		result = append(result, Factor{
+			Kind:  SharedPortsFactor,
 			Value: sharedGroupCount,
 			Reason: fmt.Sprintf(
 				"%d pairs of security groups are shared by ports",
@@ -107,23 +280,96 @@ func (groups Partition) Score() (result Score) {
 		})
 	}
 
-	for groupName, group := range groups {
-		for otherGroupName, otherGroup := range groups {
-			if group.ReferenceCount[otherGroup.Name] > 0 && otherGroup.PortCount > 0 {
-				result.Factors = append(result.Factors, Factor{
-					Value: otherGroup.PortCount * group.ReferenceCount[otherGroup.Name],
+	//each combination is recorded in all of its groups, so deduplicate by key
+	combinations := make(map[string]bool)
+	for _, group := range groups {
+		for key, portCount := range group.PortCombinations {
+			if portCount > 0 {
+				combinations[key] = true
+			}
+		}
+		for key, portCount := range group.ForeignPortCombinations {
+			if portCount > 0 && groups.containsAll(CombinationGroupIDs(key)) {
+				combinations[key] = true
+			}
+		}
+	}
+	if len(combinations) > 0 {
+		result = append(result, Factor{
+			Kind:  PortCombinationsFactor,
+			Value: uint64(len(combinations)),
+			Reason: fmt.Sprintf(
+				"%d distinct combinations of security groups are used by ports",
+				len(combinations),
+			),
+		})
+	}
+
+	for _, group := range groups {
+		for _, otherGroupID := range group.referencedGroupIDs() {
+			otherGroup := groups[otherGroupID]
+			if otherGroup == nil {
+				continue
+			}
+			refCount := group.ReferenceCountTo(otherGroupID)
+			if refCount > 0 && otherGroup.PortCount > 0 {
+				result = append(result, Factor{
+					Kind:  RemoteReferenceFactor,
+					Value: otherGroup.PortCount * refCount,
 					Reason: fmt.Sprintf(
 						"security group %s has %d rules referencing security group %s which contains %d ports",
-						groupName, group.ReferenceCount[otherGroup.Name], otherGroupName, otherGroup.PortCount,
+						group, refCount, otherGroup, otherGroup.PortCount,
+					),
+					SecurityGroupID:       group.UUID,
+					RemoteSecurityGroupID: otherGroup.UUID,
+				})
+			}
+		}
+	}
+
+	for _, group := range groups {
+		if group.IPPrefixRuleCount > 0 {
+			result = append(result, Factor{
+				Kind:            IPPrefixRulesFactor,
+				Value:           group.IPPrefixRuleCount,
+				Reason:          fmt.Sprintf("security group %s has %d rules referencing CIDRs", group, group.IPPrefixRuleCount),
+				SecurityGroupID: group.UUID,
+			})
+		}
+		for addressGroupID, ref := range group.AddressGroupReferences {
+			if ref.RuleCount > 0 {
+				result = append(result, Factor{
+					Kind:  AddressGroupReferenceFactor,
+					Value: ref.RuleCount,
+					Reason: fmt.Sprintf(
+						"security group %s has %d rules referencing address group %s which contains %d addresses",
+						group, ref.RuleCount, addressGroupID, ref.AddressCount,
 					),
+					SecurityGroupID:      group.UUID,
+					RemoteAddressGroupID: addressGroupID,
 				})
 			}
 		}
 	}
 
-	result.Value = 0
-	for _, factor := range result.Factors {
-		result.Value += factor.Value
+	return result
+}
+
+func (groups Partition) containsAll(groupIDs []string) bool {
+	for _, groupID := range groupIDs {
+		if groups[groupID] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+//ValueByKind returns the sum of all factor values of the given kind.
+func (s Score) ValueByKind(kind FactorKind) (result uint64) {
+	for _, factor := range s.Factors {
+		if factor.Kind == kind {
+			result += factor.Value
+		}
 	}
 	return result
 }
@@ -131,8 +377,8 @@ func (groups Partition) Score() (result Score) {
 //LogScore produces a log message for this partition's entanglement score.
 func (groups Partition) LogScore(score Score, projectID string) {
 	names := make([]string, 0, len(groups))
-	for groupName := range groups {
-		names = append(names, groupName)
+	for _, group := range groups {
+		names = append(names, group.String())
 	}
 	sort.Strings(names)
 
@@ -151,8 +397,9 @@ func (groups Partition) LogScore(score Score, projectID string) {
 	}
 
 	util.LogInfo(
-		"project %s contains a partition of %d security groups (%s) with entanglement %d; top %d reasons: %s",
+		"project %s contains a partition %s of %d security groups (%s) with entanglement %d; top %d reasons: %s",
 		projectID,
+		groups.ID(),
 		len(groups),
 		strings.Join(names, ", "),
 		score.Value,
@@ -0,0 +1,163 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+//Builds a project with the given number of groups. In a chain, each group
+//references the previous one, so there is only one very deep partition.
+//Otherwise, each group is connected to `edgesPerGroup` random other groups by
+//shared ports or references.
+func syntheticProject(groupCount, edgesPerGroup int, chain bool) Project {
+	p := Project{UUID: "project", Groups: make(map[string]*SecurityGroup, groupCount)}
+	groupIDs := make([]string, groupCount)
+	for idx := range groupIDs {
+		groupIDs[idx] = fmt.Sprintf("group%06d", idx)
+		p.Groups[groupIDs[idx]] = newSecurityGroup(groupIDs[idx], groupIDs[idx], 1)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	for idx, groupID := range groupIDs {
+		group := p.Groups[groupID]
+		if chain {
+			if idx > 0 {
+				group.ReferenceCount[groupIDs[idx-1]] = 1
+			}
+			continue
+		}
+		for edge := 0; edge < edgesPerGroup; edge++ {
+			otherGroupID := groupIDs[rng.Intn(groupCount)]
+			if otherGroupID == groupID {
+				continue
+			}
+			if rng.Intn(2) == 0 {
+				group.ReferenceCount[otherGroupID]++
+			} else {
+				group.SharedPortCount[otherGroupID]++
+				p.Groups[otherGroupID].SharedPortCount[groupID]++
+			}
+		}
+	}
+	return p
+}
+
+//The original recursive implementation of PartitionSecurityGroups, which
+//scans all groups for each visited group. Only suitable for small projects.
+func partitionSecurityGroupsQuadratic(p Project) (result []Partition) {
+	partitioned := make(map[string]bool)
+	for _, startGroupID := range Partition(p.Groups).SortedGroupIDs() {
+		if partitioned[startGroupID] {
+			continue
+		}
+		partition := make(Partition)
+		var addRecursively func(string)
+		addRecursively = func(groupID string) {
+			group := p.Groups[groupID]
+			partition[groupID] = group
+			partitioned[groupID] = true
+			for _, otherGroup := range p.Groups {
+				isConnected := group.SharedPortCountWith(otherGroup.UUID) > 0 ||
+					group.ReferenceCountTo(otherGroup.UUID) > 0 ||
+					otherGroup.ReferenceCountTo(group.UUID) > 0
+				if isConnected && !partitioned[otherGroup.UUID] {
+					addRecursively(otherGroup.UUID)
+				}
+			}
+		}
+		addRecursively(startGroupID)
+		result = append(result, partition)
+	}
+	return result
+}
+
+func partitionIDs(partitions []Partition) []string {
+	result := make([]string, len(partitions))
+	for idx, partition := range partitions {
+		result[idx] = partition.ID()
+	}
+	return result
+}
+
+func TestPartitionSecurityGroupsMatchesQuadraticAlgorithm(t *testing.T) {
+	for _, edgesPerGroup := range []int{0, 1, 2, 5} {
+		p := syntheticProject(500, edgesPerGroup, false)
+		expected := partitionIDs(partitionSecurityGroupsQuadratic(p))
+		actual := partitionIDs(p.PartitionSecurityGroups())
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("with %d edges per group: expected partitions %v, got %v", edgesPerGroup, expected, actual)
+		}
+	}
+
+	p := syntheticProject(500, 0, true)
+	partitions := p.PartitionSecurityGroups()
+	if len(partitions) != 1 || len(partitions[0]) != 500 {
+		t.Errorf("expected chain to form a single partition, got %d partitions", len(partitions))
+	}
+}
+
+func TestPartitionSecurityGroupsIsDeterministic(t *testing.T) {
+	p := syntheticProject(2000, 1, false)
+	expected := partitionIDs(p.PartitionSecurityGroups())
+	if len(expected) < 2 {
+		t.Fatalf("expected multiple partitions, got %d", len(expected))
+	}
+	for run := 0; run < 10; run++ {
+		actual := partitionIDs(p.PartitionSecurityGroups())
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("run %d: expected partitions %v, got %v", run, expected, actual)
+		}
+	}
+
+	//partitions are ordered by their smallest member UUID
+	smallestIDs := make([]string, len(expected))
+	for idx, partition := range p.PartitionSecurityGroups() {
+		smallestIDs[idx] = partition.SortedGroupIDs()[0]
+	}
+	if !sort.StringsAreSorted(smallestIDs) {
+		t.Errorf("partitions are not ordered by smallest member UUID: %v", smallestIDs)
+	}
+}
+
+func BenchmarkPartitionSecurityGroups(b *testing.B) {
+	for _, groupCount := range []int{10000, 50000} {
+		for _, shape := range []struct {
+			Name          string
+			EdgesPerGroup int
+			Chain         bool
+		}{
+			{"chain", 0, true},
+			{"sparse", 1, false},
+			{"dense", 10, false},
+		} {
+			p := syntheticProject(groupCount, shape.EdgesPerGroup, shape.Chain)
+			b.Run(fmt.Sprintf("%s-%d", shape.Name, groupCount), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					p.PartitionSecurityGroups()
+				}
+			})
+		}
+	}
+}
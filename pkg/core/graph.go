@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//WriteDOT renders the entanglement graph of the given partitions in the
+//Graphviz DOT format, using the same conventions as the graph in the README:
+//A dashed edge connects each pair of groups that is shared by ports, and a
+//solid edge points from a group to each remote group referenced by its rules
+//(labeled with the value of the corresponding remote_reference factor, as
+//weighted by the active scoring model, unless that value is 0). Each partition
+//is rendered as a separate cluster.
+func WriteDOT(w io.Writer, graphName string, partitions []Partition) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(graphName))
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+
+	for _, partition := range partitions {
+		score := partition.Score()
+		fmt.Fprintf(bw, "\tsubgraph %s {\n", dotQuote("cluster_"+partition.ID()))
+		fmt.Fprintf(bw, "\t\tlabel=%s;\n", dotQuote(fmt.Sprintf(
+			"partition %s (entanglement %d)", partition.ID(), score.Value,
+		)))
+
+		//key = {group UUID, remote group UUID}
+		referenceValues := make(map[[2]string]uint64)
+		for _, factor := range score.Factors {
+			if factor.Kind == RemoteReferenceFactor {
+				referenceValues[[2]string{factor.SecurityGroupID, factor.RemoteSecurityGroupID}] += factor.Value
+			}
+		}
+
+		groupIDs := partition.SortedGroupIDs()
+		for _, groupID := range groupIDs {
+			group := partition[groupID]
+			fmt.Fprintf(bw, "\t\t%s [label=%s];\n", dotQuote(groupID), dotQuote(fmt.Sprintf(
+				"%s\n%s\n%d ports", group.Name, group.UUID, group.PortCount,
+			)))
+		}
+
+		for _, groupID := range groupIDs {
+			group := partition[groupID]
+			for _, otherGroupID := range groupIDs {
+				otherGroup := partition[otherGroupID]
+				//shared ports are symmetric, so only render each pair once
+				if portCount := group.SharedPortCountWith(otherGroupID); groupID < otherGroupID && portCount > 0 {
+					fmt.Fprintf(bw, "\t\t%s -> %s [style=dashed, dir=none, tooltip=%s];\n",
+						dotQuote(groupID), dotQuote(otherGroupID),
+						dotQuote(fmt.Sprintf("%d shared ports", portCount)),
+					)
+				}
+				if refCount := group.ReferenceCountTo(otherGroupID); refCount > 0 {
+					//omit the label when the rules do not add to the score (e.g.
+					//because the remote group has no ports)
+					attrs := ""
+					if value := referenceValues[[2]string{groupID, otherGroupID}]; value > 0 {
+						attrs = fmt.Sprintf("label=%s, ", dotQuote(fmt.Sprintf("%d", value)))
+					}
+					fmt.Fprintf(bw, "\t\t%s -> %s [%stooltip=%s];\n",
+						dotQuote(groupID), dotQuote(otherGroupID), attrs,
+						dotQuote(fmt.Sprintf("%d rules referencing %d ports", refCount, otherGroup.PortCount)),
+					)
+				}
+			}
+		}
+
+		fmt.Fprintln(bw, "\t}")
+	}
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(str string) string {
+	return `"` + dotEscaper.Replace(str) + `"`
+}
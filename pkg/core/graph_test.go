@@ -0,0 +1,51 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteDOTReferenceLabels(t *testing.T) {
+	p := exampleProject()
+	p.Groups["empty"] = newSecurityGroup("empty", "empty-name", 0)
+	p.Groups["app"].ReferenceCount["empty"] = 1
+
+	var buf bytes.Buffer
+	err := WriteDOT(&buf, "example", p.PartitionSecurityGroups())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+
+	expectedLines := []string{
+		`"default" -> "jump" [label="2", tooltip="1 rules referencing 2 ports"];`,
+		`"db" -> "app" [label="10", tooltip="1 rules referencing 10 ports"];`,
+		//the reference to the group without ports does not add to the score
+		`"app" -> "empty" [tooltip="1 rules referencing 0 ports"];`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(dot, "\t\t"+line+"\n") {
+			t.Errorf("expected line %q in output:\n%s", line, dot)
+		}
+	}
+}
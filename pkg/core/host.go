@@ -0,0 +1,99 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+//HostScores computes an entanglement score for each host that ports are
+//bound to (key = host name), as an estimate for the load on the agent that
+//manages the ports on that host. Since the agent only sees the ports on its
+//own host, shared ports and port combinations are only counted for those
+//ports, and partitions are formed only from the groups that have ports on
+//this host. However, rules referencing a remote group require the agent to
+//know about all ports in the remote group, so references count all of the
+//remote group's ports, regardless of their host.
+//
+//The score of a host is the sum of the scores of all partitions on it.
+//Security groups of all projects are considered together, since an agent
+//serves the ports of all projects on its host.
+func HostScores(projects map[string]*Project) map[string]uint64 {
+	groupsByHost := make(map[string][]*SecurityGroup)
+	allGroups := make(map[string]*SecurityGroup)
+	for _, project := range projects {
+		for groupID, group := range project.Groups {
+			allGroups[groupID] = group
+			for host := range group.HostPortCombinations {
+				groupsByHost[host] = append(groupsByHost[host], group)
+			}
+		}
+	}
+
+	result := make(map[string]uint64, len(groupsByHost))
+	for host, groups := range groupsByHost {
+		view := hostView(host, groups, allGroups)
+		for _, partition := range view.PartitionSecurityGroups() {
+			result[host] += partition.Score().Value
+		}
+	}
+	return result
+}
+
+//Builds a pseudo-project containing the given groups with ports on the given
+//host (and the remote groups referenced by them), as seen by the agent on
+//that host.
+func hostView(host string, groups []*SecurityGroup, allGroups map[string]*SecurityGroup) Project {
+	view := Project{UUID: host, Groups: make(map[string]*SecurityGroup)}
+	getViewGroup := func(source *SecurityGroup) *SecurityGroup {
+		group, exists := view.Groups[source.UUID]
+		if !exists {
+			group = newSecurityGroup(source.UUID, source.Name, source.PortCount)
+			view.Groups[source.UUID] = group
+		}
+		return group
+	}
+
+	for _, source := range groups {
+		group := getViewGroup(source)
+		for key, portCount := range source.HostPortCombinations[host] {
+			groupIDs := CombinationGroupIDs(key)
+			if len(groupIDs) > 1 {
+				group.PortCombinations[key] = portCount
+			}
+			for _, otherGroupID := range groupIDs {
+				if otherGroupID != source.UUID {
+					group.SharedPortCount[otherGroupID] += portCount
+				}
+			}
+		}
+
+		//rules are only enforced on this host if the group has ports here, so
+		//only groups with ports here contribute references and rule counts
+		group.IPPrefixRuleCount = source.IPPrefixRuleCount
+		group.AddressGroupReferences = source.AddressGroupReferences
+		for _, refs := range []map[string]uint64{source.ReferenceCount, source.ForeignReferenceCount} {
+			for remoteGroupID, refCount := range refs {
+				if remoteGroup, exists := allGroups[remoteGroupID]; exists && refCount > 0 {
+					getViewGroup(remoteGroup)
+					group.ReferenceCount[remoteGroupID] = refCount
+				}
+			}
+		}
+	}
+
+	return view
+}
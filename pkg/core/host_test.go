@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+//Records that the given number of ports in exactly the given groups are bound
+//to the given host.
+func addHostPorts(projects map[string]*Project, host string, groupIDs []string, count uint64) {
+	key := CombinationKey(groupIDs)
+	for _, project := range projects {
+		for _, groupID := range groupIDs {
+			group := project.Groups[groupID]
+			if group == nil {
+				continue
+			}
+			if group.HostPortCombinations[host] == nil {
+				group.HostPortCombinations[host] = make(map[string]uint64)
+			}
+			group.HostPortCombinations[host][key] += count
+		}
+	}
+}
+
+func TestHostScores(t *testing.T) {
+	//the README example (plus the reference from the app servers to the "svc"
+	//group in another project), with the ports spread across multiple hosts
+	projects := exampleProjectsWithForeignReference()
+	addHostPorts(projects, "node1", []string{"app", "default"}, 6)
+	addHostPorts(projects, "node1", []string{"db", "default"}, 1)
+	addHostPorts(projects, "node2", []string{"app", "default"}, 4)
+	addHostPorts(projects, "node2", []string{"jump"}, 2)
+	addHostPorts(projects, "node3", []string{"svc"}, 5)
+
+	expected := map[string]uint64{
+		//2 shared pairs, and the references to all 2 jump servers (even though
+		//they are not on this host), all 10 app servers (not just the 6 on this
+		//host) and all 5 ports in "svc" (from the other project)
+		"node1": 2 + 2 + 10 + 5,
+		//1 shared pair, and the references to the jump servers and to "svc";
+		//the database group has no ports here, so its rule does not count
+		"node2": 1 + 2 + 5,
+		//"svc" does not have rules or shared ports
+		"node3": 0,
+	}
+	if actual := HostScores(projects); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected host scores %v, got %v", expected, actual)
+	}
+}
+
+func TestHostViewCountsRemoteGroupsGlobally(t *testing.T) {
+	projects := exampleProjectsWithForeignReference()
+	addHostPorts(projects, "node1", []string{"db", "default"}, 1)
+
+	allGroups := make(map[string]*SecurityGroup)
+	for _, project := range projects {
+		for groupID, group := range project.Groups {
+			allGroups[groupID] = group
+		}
+	}
+	view := hostView("node1", []*SecurityGroup{allGroups["db"], allGroups["default"]}, allGroups)
+
+	//"app" and "jump" do not have ports on this host, but are referenced by
+	//groups that do, so they appear with all their ports
+	expectedPortCounts := map[string]uint64{"app": 10, "db": 1, "default": 11, "jump": 2}
+	actualPortCounts := make(map[string]uint64)
+	for groupID, group := range view.Groups {
+		actualPortCounts[groupID] = group.PortCount
+	}
+	if !reflect.DeepEqual(actualPortCounts, expectedPortCounts) {
+		t.Errorf("expected groups with port counts %v, got %v", expectedPortCounts, actualPortCounts)
+	}
+	//"app" only contributes references from groups with ports on this host, so
+	//its reference to "svc" is not included
+	if refs := view.Groups["app"].ReferenceCount; len(refs) != 0 {
+		t.Errorf("expected no references from app, got %v", refs)
+	}
+	if shared := view.Groups["db"].SharedPortCount; !reflect.DeepEqual(shared, map[string]uint64{"default": 1}) {
+		t.Errorf("expected db to share 1 port with default, got %v", shared)
+	}
+}
@@ -0,0 +1,139 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//KeystoneAuth contains the credentials for a Keystone v3 password
+//authentication with project scope.
+type KeystoneAuth struct {
+	AuthURL           string
+	Username          string
+	UserDomainName    string
+	Password          string
+	ProjectName       string
+	ProjectDomainName string
+	//Region and interface of the Neutron endpoint in the service catalog.
+	RegionName string
+	Interface  string
+}
+
+type keystoneTokenRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+					Domain   struct {
+						Name string `json:"name"`
+					} `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope struct {
+			Project struct {
+				Name   string `json:"name"`
+				Domain struct {
+					Name string `json:"name"`
+				} `json:"domain"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+type keystoneTokenResponse struct {
+	Token struct {
+		Catalog []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+//Authenticate obtains a token from Keystone, and returns it along with the
+//Neutron endpoint URL from the service catalog.
+func (a KeystoneAuth) Authenticate(ctx context.Context, client *http.Client) (token, endpoint string, err error) {
+	var req keystoneTokenRequest
+	req.Auth.Identity.Methods = []string{"password"}
+	req.Auth.Identity.Password.User.Name = a.Username
+	req.Auth.Identity.Password.User.Password = a.Password
+	req.Auth.Identity.Password.User.Domain.Name = a.UserDomainName
+	req.Auth.Scope.Project.Name = a.ProjectName
+	req.Auth.Scope.Project.Domain.Name = a.ProjectDomainName
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	url := strings.TrimSuffix(a.AuthURL, "/") + "/auth/tokens"
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("POST %s returned %s", url, resp.Status)
+	}
+
+	token = resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", "", errors.New("Keystone did not return a token")
+	}
+	var data keystoneTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return "", "", err
+	}
+
+	iface := a.Interface
+	if iface == "" {
+		iface = "public"
+	}
+	for _, service := range data.Token.Catalog {
+		if service.Type != "network" {
+			continue
+		}
+		for _, ep := range service.Endpoints {
+			if ep.Interface == iface && (a.RegionName == "" || ep.Region == a.RegionName) {
+				return token, ep.URL, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no %s endpoint for service type \"network\" in region %q found in Keystone catalog", iface, a.RegionName)
+}
@@ -0,0 +1,351 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//NeutronClient is a minimal client for the parts of the Neutron API that
+//CollectDataFromNeutronAPI needs.
+type NeutronClient struct {
+	//Base URL of the Neutron API (e.g. "https://network.example.com:9696").
+	//If empty, it is taken from the Keystone catalog.
+	Endpoint string
+	//Keystone token. If empty, it is obtained using Auth.
+	Token string
+	//Credentials for obtaining a token. May be nil if Endpoint and Token are given.
+	Auth *KeystoneAuth
+	//HTTP client to use (default: http.DefaultClient). Regardless of its
+	//timeout, all requests are aborted when the context given to
+	//CollectDataFromNeutronAPI() expires.
+	HTTPClient *http.Client
+}
+
+//NewNeutronClient creates a NeutronClient from the given configuration. Each
+//request is aborted when it takes longer than cfg.QueryTimeout.
+func NewNeutronClient(cfg Config) *NeutronClient {
+	c := &NeutronClient{
+		Endpoint:   cfg.NeutronAPI.Endpoint,
+		Token:      cfg.NeutronAPI.Token,
+		HTTPClient: &http.Client{Timeout: cfg.QueryTimeout},
+	}
+	if cfg.NeutronAPI.Auth.AuthURL != "" {
+		auth := cfg.NeutronAPI.Auth
+		c.Auth = &auth
+	}
+	return c
+}
+
+func (c *NeutronClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *NeutronClient) authenticate(ctx context.Context) error {
+	if c.Auth == nil {
+		return fmt.Errorf("no Keystone credentials configured for Neutron API access")
+	}
+	token, endpoint, err := c.Auth.Authenticate(ctx, c.httpClient())
+	if err != nil {
+		return err
+	}
+	c.Token = token
+	if c.Endpoint == "" {
+		c.Endpoint = endpoint
+	}
+	return nil
+}
+
+//Neutron's collection responses look like
+//
+//	{ "ports": [ ... ], "ports_links": [ { "rel": "next", "href": "..." } ] }
+//
+//listAll() follows the "next" links until all pages have been retrieved, and
+//calls handlePage for each page's JSON list.
+func (c *NeutronClient) listAll(ctx context.Context, path string, fields []string, handlePage func(json.RawMessage) error) error {
+	if c.Token == "" || c.Endpoint == "" {
+		err := c.authenticate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	resource := strings.Replace(strings.TrimPrefix(path, "/v2.0/"), "-", "_", -1)
+	query := url.Values{"fields": fields}
+	nextURL := strings.TrimSuffix(c.Endpoint, "/") + path + "?" + query.Encode()
+	reauthenticated := false
+
+	for nextURL != "" {
+		currentURL := nextURL
+		req, err := http.NewRequest("GET", currentURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Auth-Token", c.Token)
+
+		resp, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		//token may have expired since the last collection -> get a new one (once)
+		if resp.StatusCode == http.StatusUnauthorized && c.Auth != nil && !reauthenticated {
+			resp.Body.Close()
+			err := c.authenticate(ctx)
+			if err != nil {
+				return err
+			}
+			reauthenticated = true
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s returned %s", currentURL, resp.Status)
+		}
+
+		var page map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot decode response for GET %s: %s", currentURL, err.Error())
+		}
+		err = handlePage(page[resource])
+		if err != nil {
+			return fmt.Errorf("cannot decode response for GET %s: %s", currentURL, err.Error())
+		}
+
+		nextURL = ""
+		var links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		}
+		if linksJSON, exists := page[resource+"_links"]; exists {
+			err = json.Unmarshal(linksJSON, &links)
+			if err != nil {
+				return fmt.Errorf("cannot decode response for GET %s: %s", currentURL, err.Error())
+			}
+		}
+		for _, link := range links {
+			if link.Rel == "next" {
+				nextURL = link.Href
+			}
+		}
+	}
+
+	return nil
+}
+
+type neutronSecurityGroup struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ProjectID string `json:"project_id"`
+	TenantID  string `json:"tenant_id"`
+}
+
+type neutronSecurityGroupRule struct {
+	SecurityGroupID      string  `json:"security_group_id"`
+	RemoteGroupID        *string `json:"remote_group_id"`
+	RemoteIPPrefix       *string `json:"remote_ip_prefix"`
+	RemoteAddressGroupID *string `json:"remote_address_group_id"`
+}
+
+type neutronAddressGroup struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+}
+
+type neutronPort struct {
+	SecurityGroupIDs []string `json:"security_groups"`
+	HostID           string   `json:"binding:host_id"`
+}
+
+//CollectDataFromNeutronAPI gathers data about all security groups in all
+//projects from the Neutron API. The result has the same structure as for
+//CollectData(). The Keystone user needs to be allowed to list the
+//resources of all projects (usually by having the "admin" role). All
+//requests are aborted when the given context expires.
+func CollectDataFromNeutronAPI(ctx context.Context, client *NeutronClient) (map[string]*Project, error) {
+	result := make(map[string]*Project)
+
+	//list all security groups in all projects
+	groupsByID := make(map[string]neutronSecurityGroup)
+	err := client.listAll(ctx, "/v2.0/security-groups", []string{"id", "name", "project_id", "tenant_id"}, func(data json.RawMessage) error {
+		var groups []neutronSecurityGroup
+		err := json.Unmarshal(data, &groups)
+		for _, group := range groups {
+			if group.ProjectID == "" {
+				group.ProjectID = group.TenantID //pre-Newton Neutron
+			}
+			groupsByID[group.ID] = group
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//find the security groups for each port, and count ports on each host by
+	//the exact set of security groups they are in
+	var portsGroupIDs [][]string
+	hostCombinationPortCounts := make(map[string]map[string]uint64)
+	err = client.listAll(ctx, "/v2.0/ports", []string{"id", "security_groups", "binding:host_id"}, func(data json.RawMessage) error {
+		var ports []neutronPort
+		err := json.Unmarshal(data, &ports)
+		for _, port := range ports {
+			if len(port.SecurityGroupIDs) == 0 {
+				continue
+			}
+			portsGroupIDs = append(portsGroupIDs, port.SecurityGroupIDs)
+			if port.HostID != "" {
+				if hostCombinationPortCounts[port.HostID] == nil {
+					hostCombinationPortCounts[port.HostID] = make(map[string]uint64)
+				}
+				hostCombinationPortCounts[port.HostID][CombinationKey(port.SecurityGroupIDs)]++
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//count ports per security group (like securityGroupsQuery, this only
+	//reports groups that have at least one port)
+	for _, groupIDs := range portsGroupIDs {
+		for _, groupID := range groupIDs {
+			group, exists := groupsByID[groupID]
+			if !exists {
+				continue
+			}
+			project, exists := result[group.ProjectID]
+			if !exists {
+				project = &Project{group.ProjectID, make(map[string]*SecurityGroup)}
+				result[group.ProjectID] = project
+			}
+			sg, exists := project.Groups[group.ID]
+			if !exists {
+				sg = newSecurityGroup(group.ID, group.Name, 0)
+				project.Groups[group.ID] = sg
+			}
+			sg.PortCount++
+		}
+	}
+
+	//the remaining steps can connect groups across project boundaries
+	directory := newGroupDirectory(result)
+
+	//count ports shared by multiple security groups
+	for _, groupIDs := range portsGroupIDs {
+		for _, groupID1 := range groupIDs {
+			for _, groupID2 := range groupIDs {
+				if groupID1 < groupID2 {
+					directory.addSharedPorts(groupID1, groupID2, 1)
+				}
+			}
+		}
+	}
+
+	//count ports by the exact set of security groups they are in
+	combinationPortCounts := make(map[string]uint64)
+	for _, groupIDs := range portsGroupIDs {
+		if len(groupIDs) > 1 {
+			combinationPortCounts[CombinationKey(groupIDs)]++
+		}
+	}
+	for key, portCount := range combinationPortCounts {
+		directory.addPortCombination(key, portCount)
+	}
+	for host, portCounts := range hostCombinationPortCounts {
+		for key, portCount := range portCounts {
+			directory.addHostPortCombination(host, key, portCount)
+		}
+	}
+
+	//find security groups with rules referencing other security groups, CIDRs
+	//or address groups
+	addressGroupRefsByID := make(map[string][]*AddressGroupReference)
+	ruleFields := []string{"id", "security_group_id", "remote_group_id", "remote_ip_prefix", "remote_address_group_id"}
+	err = client.listAll(ctx, "/v2.0/security-group-rules", ruleFields, func(data json.RawMessage) error {
+		var rules []neutronSecurityGroupRule
+		err := json.Unmarshal(data, &rules)
+		for _, rule := range rules {
+			group, exists := groupsByID[rule.SecurityGroupID]
+			if !exists {
+				continue
+			}
+			//This is coded defensively, just like in CollectData().
+			project, exists := result[group.ProjectID]
+			if !exists {
+				continue
+			}
+			sg, exists := project.Groups[group.ID]
+			if !exists {
+				continue
+			}
+
+			switch {
+			case rule.RemoteGroupID != nil:
+				directory.addReferences(sg.UUID, *rule.RemoteGroupID, 1)
+			case rule.RemoteIPPrefix != nil:
+				sg.IPPrefixRuleCount++
+			case rule.RemoteAddressGroupID != nil:
+				ref, exists := sg.AddressGroupReferences[*rule.RemoteAddressGroupID]
+				if !exists {
+					ref = &AddressGroupReference{}
+					sg.AddressGroupReferences[*rule.RemoteAddressGroupID] = ref
+					addressGroupRefsByID[*rule.RemoteAddressGroupID] = append(addressGroupRefsByID[*rule.RemoteAddressGroupID], ref)
+				}
+				ref.RuleCount++
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//count addresses in referenced address groups (only if there are any
+	//references, since older Neutrons do not have the address-group extension)
+	if len(addressGroupRefsByID) > 0 {
+		err = client.listAll(ctx, "/v2.0/address-groups", []string{"id", "addresses"}, func(data json.RawMessage) error {
+			var addressGroups []neutronAddressGroup
+			err := json.Unmarshal(data, &addressGroups)
+			for _, ag := range addressGroups {
+				for _, ref := range addressGroupRefsByID[ag.ID] {
+					ref.AddressCount = uint64(len(ag.Addresses))
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
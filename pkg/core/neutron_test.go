@@ -0,0 +1,205 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeNeutron serves a Keystone token endpoint and paginated Neutron listings
+//(with a page size of 2).
+type fakeNeutron struct {
+	server *httptest.Server
+	//key = resource name (e.g. "ports")
+	resources map[string][]map[string]interface{}
+
+	mutex      sync.Mutex
+	validToken string
+	tokenCount int
+	//key = resource name
+	requestCounts map[string]int
+}
+
+func newFakeNeutron(t *testing.T) *fakeNeutron {
+	f := &fakeNeutron{
+		resources:     make(map[string][]map[string]interface{}),
+		requestCounts: make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeNeutron) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Method == "POST" && r.URL.Path == "/v3/auth/tokens" {
+		f.tokenCount++
+		f.validToken = "token" + strconv.Itoa(f.tokenCount)
+		w.Header().Set("X-Subject-Token", f.validToken)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":{"catalog":[{"type":"network","endpoints":[{"interface":"public","region":"region1","url":"%s/neutron"}]}]}}`, f.server.URL)
+		return
+	}
+
+	resource := strings.Replace(strings.TrimPrefix(r.URL.Path, "/neutron/v2.0/"), "-", "_", -1)
+	items, exists := f.resources[resource]
+	if r.Method != "GET" || !exists {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != f.validToken {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	f.requestCounts[resource]++
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	start, end := 2*page, 2*page+2
+	if end > len(items) {
+		end = len(items)
+	}
+	body := map[string]interface{}{resource: items[start:end]}
+	if end < len(items) {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		body[resource+"_links"] = []map[string]string{
+			{"rel": "next", "href": f.server.URL + r.URL.Path + "?" + query.Encode()},
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestCollectDataFromNeutronAPI(t *testing.T) {
+	f := newFakeNeutron(t)
+	group := func(id, projectID string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "name": "group-" + id, "project_id": projectID}
+	}
+	port := func(hostID string, groupIDs ...string) map[string]interface{} {
+		return map[string]interface{}{"security_groups": groupIDs, "binding:host_id": hostID}
+	}
+	rule := func(groupID, field, value string) map[string]interface{} {
+		return map[string]interface{}{"security_group_id": groupID, field: value}
+	}
+	f.resources["security_groups"] = []map[string]interface{}{
+		group("a", "p"), group("b", "p"), group("c", "p"), group("d", "q"), group("unused", "p"),
+	}
+	f.resources["ports"] = []map[string]interface{}{
+		port("node1", "a", "b"), port("node1", "b", "a"), port("node2", "c"),
+		port("", "a", "d"), port("node2", "b"), port("node1"),
+	}
+	f.resources["security_group_rules"] = []map[string]interface{}{
+		rule("b", "remote_group_id", "c"), rule("b", "remote_group_id", "c"),
+		rule("a", "remote_ip_prefix", "10.0.0.0/8"), rule("d", "remote_group_id", "a"),
+		rule("unused", "remote_group_id", "a"),
+	}
+
+	//start with an expired token to check that the client reauthenticates
+	client := &NeutronClient{
+		Endpoint: f.server.URL + "/neutron",
+		Token:    "expired",
+		Auth:     &KeystoneAuth{AuthURL: f.server.URL + "/v3"},
+	}
+	projects, err := CollectDataFromNeutronAPI(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.tokenCount != 1 {
+		t.Errorf("expected client to authenticate once, but got %d tokens", f.tokenCount)
+	}
+	//each listing has 3 pages (requests rejected with 401 are not counted)
+	expectedRequestCounts := map[string]int{"security_groups": 3, "ports": 3, "security_group_rules": 3}
+	if !reflect.DeepEqual(f.requestCounts, expectedRequestCounts) {
+		t.Errorf("expected requests %v, got %v", expectedRequestCounts, f.requestCounts)
+	}
+
+	keyAB := CombinationKey([]string{"a", "b"})
+	keyAD := CombinationKey([]string{"a", "d"})
+	expected := map[string]*Project{
+		"p": {UUID: "p", Groups: map[string]*SecurityGroup{
+			"a": newSecurityGroup("a", "group-a", 3),
+			"b": newSecurityGroup("b", "group-b", 3),
+			"c": newSecurityGroup("c", "group-c", 1),
+		}},
+		"q": {UUID: "q", Groups: map[string]*SecurityGroup{
+			"d": newSecurityGroup("d", "group-d", 1),
+		}},
+	}
+	a, b, c, d := expected["p"].Groups["a"], expected["p"].Groups["b"], expected["p"].Groups["c"], expected["q"].Groups["d"]
+	a.SharedPortCount["b"] = 2
+	b.SharedPortCount["a"] = 2
+	a.ForeignSharedPortCount["d"] = 1
+	d.ForeignSharedPortCount["a"] = 1
+	a.PortCombinations[keyAB] = 2
+	b.PortCombinations[keyAB] = 2
+	a.ForeignPortCombinations[keyAD] = 1
+	d.ForeignPortCombinations[keyAD] = 1
+	a.HostPortCombinations["node1"] = map[string]uint64{keyAB: 2}
+	b.HostPortCombinations["node1"] = map[string]uint64{keyAB: 2}
+	b.HostPortCombinations["node2"] = map[string]uint64{"b": 1}
+	c.HostPortCombinations["node2"] = map[string]uint64{"c": 1}
+	b.ReferenceCount["c"] = 2
+	d.ForeignReferenceCount["a"] = 1
+	a.IPPrefixRuleCount = 1
+
+	if !reflect.DeepEqual(projects, expected) {
+		actualJSON, _ := json.Marshal(projects)
+		expectedJSON, _ := json.Marshal(expected)
+		t.Errorf("expected projects\n\t%s\ngot\n\t%s", expectedJSON, actualJSON)
+	}
+}
+
+func TestCollectDataFromNeutronAPIHonorsContext(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	client := &NeutronClient{Endpoint: server.URL, Token: "token"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	startedAt := time.Now()
+	_, err := CollectDataFromNeutronAPI(ctx, client)
+	if err == nil {
+		t.Fatal("expected error from hung Neutron API, got nil")
+	}
+	if duration := time.Since(startedAt); duration > 5*time.Second {
+		t.Errorf("expected collection to be aborted after 100ms, but it took %s", duration)
+	}
+}
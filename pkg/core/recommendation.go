@@ -0,0 +1,262 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/util"
+)
+
+//Recommendation is a change to the security groups in a partition that
+//reduces its entanglement score.
+type Recommendation struct {
+	Mutation    Mutation `json:"mutation"`
+	Description string   `json:"description"`
+	//How much this change reduces the highest partition score and the sum of
+	//all partition scores (when applied after all previous recommendations).
+	ScoreReduction      uint64 `json:"score_reduction"`
+	TotalScoreReduction uint64 `json:"total_score_reduction"`
+}
+
+//Upper bound for the number of recommendations for a single partition.
+const maxRecommendations = 10
+
+//Upper bound for the number of groups in a partition for which Recommend()
+//searches for changes. Each step of the search scores every possible change,
+//so the runtime grows quadratically with the size of the partition.
+const maxRecommendationGroups = 250
+
+//Recommend computes a small set of changes that brings the entanglement score
+//of this partition (or, if the changes split it up, the highest score of the
+//resulting partitions) to at most `target`. There are two types of changes:
+//
+//1. Remove rules referencing a remote group (and reference a CIDR instead).
+//2. For two groups that share ports, move the shared ports out of one group.
+//
+//Only references and shared ports between groups in the same project are
+//considered.
+//
+//The changes are chosen greedily: At each step, the change that results in
+//the lowest highest partition score is chosen. Ties are broken by the sum of
+//all partition scores, and then by the other partition scores in descending
+//order. (Without these criteria, the search would get stuck as soon as a
+//change splits the partition into parts with equal scores.) The result is in
+//the order in which the changes were chosen.
+//
+//If the target cannot be reached within maxRecommendations steps, the changes
+//found so far are returned. For partitions with more than
+//maxRecommendationGroups groups, no changes are recommended. In both cases,
+//the returned remainingScore (the highest partition score after applying all
+//returned changes) is larger than the target.
+func (groups Partition) Recommend(target uint64) (result []Recommendation, remainingScore uint64) {
+	project := Project{Groups: groups}.Clone()
+	current := newScoreOutcome(project.partitionScores())
+	if len(groups) > maxRecommendationGroups {
+		return nil, current.max()
+	}
+
+	for current.max() > target && len(result) < maxRecommendations {
+		//each change only affects the partition containing its groups, so
+		//only that partition needs to be scored again for each candidate
+		partitions := project.PartitionSecurityGroups()
+		scores := make([]uint64, len(partitions))
+		partitionIndexByGroupID := make(map[string]int)
+		for idx, partition := range partitions {
+			scores[idx] = partition.Score().Value
+			for groupID := range partition {
+				partitionIndexByGroupID[groupID] = idx
+			}
+		}
+
+		var (
+			best        *Recommendation
+			bestOutcome = current
+		)
+		for _, candidate := range project.recommendationCandidates() {
+			idx := partitionIndexByGroupID[candidate.Mutation.SecurityGroupID]
+			if candidate.Mutation.Kind == MovePorts {
+				idx = partitionIndexByGroupID[candidate.Mutation.SecurityGroupIDs[0]]
+			}
+			mutated := Project{Groups: partitions[idx]}.Clone()
+			if mutated.apply(candidate.Mutation) != nil {
+				continue
+			}
+
+			candidateScores := mutated.partitionScores()
+			for otherIdx, otherScore := range scores {
+				if otherIdx != idx {
+					candidateScores = append(candidateScores, otherScore)
+				}
+			}
+			outcome := newScoreOutcome(candidateScores)
+			if outcome.isBetterThan(bestOutcome) {
+				candidate := candidate
+				best = &candidate
+				bestOutcome = outcome
+			}
+		}
+		if best == nil {
+			break //no change helps anymore
+		}
+
+		project.apply(best.Mutation)
+		best.ScoreReduction = current.max() - bestOutcome.max()
+		best.TotalScoreReduction = current.total - bestOutcome.total
+		current = bestOutcome
+		result = append(result, *best)
+	}
+
+	return result, current.max()
+}
+
+//Returns the scores of all partitions.
+func (p Project) partitionScores() []uint64 {
+	partitions := p.PartitionSecurityGroups()
+	result := make([]uint64, len(partitions))
+	for idx, partition := range partitions {
+		result[idx] = partition.Score().Value
+	}
+	return result
+}
+
+//scoreOutcome describes the partition scores of a project after applying a
+//change, for comparing changes in Recommend().
+type scoreOutcome struct {
+	//sorted descending
+	scores []uint64
+	total  uint64
+}
+
+func newScoreOutcome(scores []uint64) scoreOutcome {
+	o := scoreOutcome{scores: scores}
+	sort.Slice(o.scores, func(i, j int) bool {
+		return o.scores[i] > o.scores[j]
+	})
+	for _, score := range scores {
+		o.total += score
+	}
+	return o
+}
+
+func (o scoreOutcome) max() uint64 {
+	if len(o.scores) == 0 {
+		return 0
+	}
+	return o.scores[0]
+}
+
+func (o scoreOutcome) isBetterThan(other scoreOutcome) bool {
+	if o.max() != other.max() {
+		return o.max() < other.max()
+	}
+	if o.total != other.total {
+		return o.total < other.total
+	}
+	for idx := 0; idx < len(o.scores) && idx < len(other.scores); idx++ {
+		if o.scores[idx] != other.scores[idx] {
+			return o.scores[idx] < other.scores[idx]
+		}
+	}
+	return false
+}
+
+//Lists all possible changes (in a deterministic order).
+func (p Project) recommendationCandidates() (result []Recommendation) {
+	for _, groupID := range Partition(p.Groups).SortedGroupIDs() {
+		group := p.Groups[groupID]
+
+		//only look at groups that this group has an edge to
+		isNeighbor := make(map[string]bool)
+		for otherGroupID := range group.ReferenceCount {
+			isNeighbor[otherGroupID] = true
+		}
+		for otherGroupID := range group.SharedPortCount {
+			isNeighbor[otherGroupID] = true
+		}
+		otherGroupIDs := make([]string, 0, len(isNeighbor))
+		for otherGroupID := range isNeighbor {
+			if p.Groups[otherGroupID] != nil {
+				otherGroupIDs = append(otherGroupIDs, otherGroupID)
+			}
+		}
+		sort.Strings(otherGroupIDs)
+
+		for _, otherGroupID := range otherGroupIDs {
+			otherGroup := p.Groups[otherGroupID]
+
+			if refCount := group.ReferenceCount[otherGroupID]; refCount > 0 {
+				result = append(result, Recommendation{
+					Mutation: Mutation{
+						Kind:                  RemoveReferences,
+						SecurityGroupID:       groupID,
+						RemoteSecurityGroupID: otherGroupID,
+					},
+					Description: fmt.Sprintf(
+						"replace the %d rules in security group %s referencing security group %s with rules referencing a CIDR",
+						refCount, group, otherGroup,
+					),
+				})
+			}
+
+			if portCount := group.SharedPortCount[otherGroupID]; portCount > 0 {
+				result = append(result, Recommendation{
+					Mutation: Mutation{
+						Kind:                   MovePorts,
+						SecurityGroupIDs:       []string{groupID, otherGroupID},
+						TargetSecurityGroupIDs: []string{groupID},
+						Count:                  portCount,
+					},
+					Description: fmt.Sprintf(
+						"remove the %d ports that are in both security groups %s and %s from security group %s",
+						portCount, group, otherGroup, otherGroup,
+					),
+				})
+			}
+		}
+	}
+	return result
+}
+
+//LogRecommendations produces a log message for the recommendations computed
+//by Recommend().
+func (groups Partition) LogRecommendations(recommendations []Recommendation, remainingScore uint64, projectID string, target uint64) {
+	if len(recommendations) == 0 {
+		return
+	}
+
+	descriptions := make([]string, len(recommendations))
+	for idx, r := range recommendations {
+		descriptions[idx] = fmt.Sprintf("%s (-%d, total -%d)", r.Description, r.ScoreReduction, r.TotalScoreReduction)
+	}
+	if remainingScore > target {
+		descriptions = append(descriptions, fmt.Sprintf("target not reached (score after these changes: %d)", remainingScore))
+	}
+
+	util.LogInfo(
+		"to reduce the entanglement of partition %s in project %s to %d or less: %s",
+		groups.ID(),
+		projectID,
+		target,
+		strings.Join(descriptions, ", "),
+	)
+}
@@ -0,0 +1,151 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func onlyPartition(t *testing.T, p *Project) Partition {
+	t.Helper()
+	partitions := p.PartitionSecurityGroups()
+	if len(partitions) != 1 {
+		t.Fatalf("expected 1 partition, got %d", len(partitions))
+	}
+	return partitions[0]
+}
+
+func recommendedMutations(recommendations []Recommendation) []Mutation {
+	result := make([]Mutation, len(recommendations))
+	for idx, r := range recommendations {
+		result[idx] = r.Mutation
+	}
+	return result
+}
+
+func TestRecommendChoosesLargestReduction(t *testing.T) {
+	partition := onlyPartition(t, exampleProject())
+	recommendations, remainingScore := partition.Recommend(5)
+
+	//removing the rule referencing the 10 app servers would bring the score
+	//from 14 down to 4, but taking the app servers out of the "app" group
+	//also removes a shared pair and brings the score down to 3, so no further
+	//changes are needed
+	expected := []Recommendation{{
+		Mutation: Mutation{
+			Kind:                   MovePorts,
+			SecurityGroupIDs:       []string{"default", "app"},
+			TargetSecurityGroupIDs: []string{"default"},
+			Count:                  10,
+		},
+		ScoreReduction:      11,
+		TotalScoreReduction: 11,
+	}}
+	for idx := range recommendations {
+		recommendations[idx].Description = ""
+	}
+	if !reflect.DeepEqual(recommendations, expected) {
+		t.Errorf("expected recommendations %#v, got %#v", expected, recommendations)
+	}
+	if remainingScore != 3 {
+		t.Errorf("expected remaining score 3, got %d", remainingScore)
+	}
+}
+
+func TestRecommendStopsAtTarget(t *testing.T) {
+	partition := onlyPartition(t, exampleProject())
+
+	recommendations, remainingScore := partition.Recommend(14)
+	if len(recommendations) != 0 || remainingScore != 14 {
+		t.Errorf("expected no recommendations for a partition at the target, got %d with remaining score %d",
+			len(recommendations), remainingScore)
+	}
+
+	//after the first change (see above), the score is 3, so the rule
+	//referencing the jump servers needs to be removed as well
+	recommendations, remainingScore = partition.Recommend(1)
+	expected := []Mutation{
+		{Kind: MovePorts, SecurityGroupIDs: []string{"default", "app"}, TargetSecurityGroupIDs: []string{"default"}, Count: 10},
+		{Kind: RemoveReferences, SecurityGroupID: "default", RemoteSecurityGroupID: "jump"},
+	}
+	if actual := recommendedMutations(recommendations); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected mutations %#v, got %#v", expected, actual)
+	}
+	if remainingScore != 1 {
+		t.Errorf("expected remaining score 1, got %d", remainingScore)
+	}
+
+	//Recommend does not modify the partition
+	if actual := partition.Score().Value; actual != 14 {
+		t.Errorf("expected partition score to stay at 14, got %d", actual)
+	}
+}
+
+func TestRecommendStopsAfterMaxRecommendations(t *testing.T) {
+	//a hub group referencing more groups than can be recommended for removal
+	p := &Project{UUID: "hub", Groups: map[string]*SecurityGroup{
+		"hub": newSecurityGroup("hub", "hub", 0),
+	}}
+	for idx := 0; idx < maxRecommendations+2; idx++ {
+		groupID := fmt.Sprintf("group%02d", idx)
+		p.Groups[groupID] = newSecurityGroup(groupID, groupID, 10)
+		p.Groups["hub"].ReferenceCount[groupID] = 1
+	}
+
+	recommendations, remainingScore := onlyPartition(t, p).Recommend(0)
+	if len(recommendations) != maxRecommendations {
+		t.Errorf("expected %d recommendations, got %d", maxRecommendations, len(recommendations))
+	}
+	for _, r := range recommendations {
+		if r.Mutation.Kind != RemoveReferences || r.ScoreReduction != 10 {
+			t.Errorf("expected each recommendation to remove one reference, got %#v", r)
+		}
+	}
+	if remainingScore != 20 {
+		t.Errorf("expected remaining score 20, got %d", remainingScore)
+	}
+}
+
+func TestRecommendSkipsLargePartitions(t *testing.T) {
+	p := syntheticProject(maxRecommendationGroups+1, 0, true)
+	partition := onlyPartition(t, &p)
+
+	recommendations, remainingScore := partition.Recommend(0)
+	if len(recommendations) != 0 {
+		t.Errorf("expected no recommendations for a partition with %d groups, got %d", len(partition), len(recommendations))
+	}
+	if expected := partition.Score().Value; remainingScore != expected {
+		t.Errorf("expected remaining score %d, got %d", expected, remainingScore)
+	}
+}
+
+func TestRecommendBreaksTies(t *testing.T) {
+	//in a chain, every change brings the highest score down by the same amount
+	//at first, so the search only makes progress if it prefers changes that
+	//also reduce the other scores
+	p := syntheticProject(20, 0, true)
+	recommendations, remainingScore := onlyPartition(t, &p).Recommend(5)
+	if remainingScore > 5 {
+		t.Errorf("expected target to be reached, but remaining score is %d after %d recommendations",
+			remainingScore, len(recommendations))
+	}
+}
@@ -0,0 +1,194 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+//Report contains the partitions and scores of all projects from one
+//collection. Once created, a Report must not be modified, so that it can be
+//shared between goroutines without locking.
+type Report struct {
+	CollectedAt time.Time
+	//Name of the Scorer that computed the scores.
+	ScoringModel string
+	//key = project UUID
+	Projects map[string]*ProjectReport
+	//key = host name (see HostScores)
+	HostScores map[string]uint64
+}
+
+//ProjectReport contains the partitions and scores of a single project. In a
+//Report, the partitions can also contain security groups from other projects
+//(see PartitionAllSecurityGroups). Such partitions are reported in each
+//project that they contain groups of.
+type ProjectReport struct {
+	Project    *Project
+	Partitions []PartitionReport
+	MaxScore   uint64
+	TotalScore uint64
+	//Sum of factor values across all partitions, split by kind.
+	TotalScoreByFactorKind map[FactorKind]uint64
+	//Sum of scores across all partitions that is attributed to the security
+	//groups of other projects (key = other project's UUID). For each
+	//partition, this is how much its score would drop if it did not contain
+	//the other project's groups.
+	ForeignScores map[string]uint64
+}
+
+//PartitionReport contains a single partition and its score.
+type PartitionReport struct {
+	Partition Partition
+	Score     Score
+}
+
+//NewReport partitions and scores all the given projects. Partitions may span
+//multiple projects.
+func NewReport(projects map[string]*Project, collectedAt time.Time) *Report {
+	report := &Report{
+		CollectedAt:  collectedAt,
+		ScoringModel: activeScorer.Name(),
+		Projects:     make(map[string]*ProjectReport, len(projects)),
+		HostScores:   HostScores(projects),
+	}
+
+	projectIDByGroupID := make(map[string]string)
+	for projectID, project := range projects {
+		report.Projects[projectID] = newProjectReport(project)
+		for groupID := range project.Groups {
+			projectIDByGroupID[groupID] = projectID
+		}
+	}
+
+	for _, partition := range PartitionAllSecurityGroups(projects) {
+		part := PartitionReport{partition, partition.Score()}
+		groupsByProjectID := make(map[string]Partition)
+		for groupID, group := range partition {
+			projectID := projectIDByGroupID[groupID]
+			if groupsByProjectID[projectID] == nil {
+				groupsByProjectID[projectID] = make(Partition)
+			}
+			groupsByProjectID[projectID][groupID] = group
+		}
+
+		for projectID := range groupsByProjectID {
+			report.Projects[projectID].addPartition(part)
+		}
+		if len(groupsByProjectID) == 1 {
+			continue
+		}
+		for foreignProjectID, foreignGroups := range groupsByProjectID {
+			foreignScore := saturatingSub(part.Score.Value, partition.without(foreignGroups).Score().Value)
+			for projectID := range groupsByProjectID {
+				if projectID != foreignProjectID && foreignScore > 0 {
+					report.Projects[projectID].ForeignScores[foreignProjectID] += foreignScore
+				}
+			}
+		}
+	}
+
+	return report
+}
+
+//NewProjectReport partitions and scores the given project, ignoring edges to
+//security groups in other projects.
+func NewProjectReport(project *Project) *ProjectReport {
+	pr := newProjectReport(project)
+	for _, partition := range project.PartitionSecurityGroups() {
+		pr.addPartition(PartitionReport{partition, partition.Score()})
+	}
+	return pr
+}
+
+func newProjectReport(project *Project) *ProjectReport {
+	return &ProjectReport{
+		Project:                project,
+		TotalScoreByFactorKind: make(map[FactorKind]uint64, len(AllFactorKinds)),
+		ForeignScores:          make(map[string]uint64),
+	}
+}
+
+func (pr *ProjectReport) addPartition(part PartitionReport) {
+	pr.Partitions = append(pr.Partitions, part)
+	pr.TotalScore += part.Score.Value
+	for _, kind := range AllFactorKinds {
+		pr.TotalScoreByFactorKind[kind] += part.Score.ValueByKind(kind)
+	}
+	if pr.MaxScore < part.Score.Value {
+		pr.MaxScore = part.Score.Value
+	}
+}
+
+//Returns a copy of this partition without the given groups. The result is
+//not necessarily connected, but can still be scored.
+func (groups Partition) without(removed Partition) Partition {
+	result := make(Partition, len(groups))
+	for groupID, group := range groups {
+		if removed[groupID] == nil {
+			result[groupID] = group
+		}
+	}
+	return result
+}
+
+//SecurityGroup finds a security group in the partitions of this project.
+//Unlike pr.Project.Groups, this also finds groups from other projects.
+//Returns nil if the group is not in any partition.
+func (pr ProjectReport) SecurityGroup(groupID string) *SecurityGroup {
+	for _, part := range pr.Partitions {
+		if group := part.Partition[groupID]; group != nil {
+			return group
+		}
+	}
+	return nil
+}
+
+//TopFactors returns the n factors with the highest values across all
+//partitions of this project, sorted descending by value. Only factors that
+//can be attributed to a specific pair of security groups (i.e. remote
+//references) are considered.
+func (pr ProjectReport) TopFactors(n int) []Factor {
+	var factors []Factor
+	for _, part := range pr.Partitions {
+		for _, factor := range part.Score.Factors {
+			if factor.RemoteSecurityGroupID != "" {
+				factors = append(factors, factor)
+			}
+		}
+	}
+
+	sort.Slice(factors, func(i, j int) bool {
+		fi, fj := factors[i], factors[j]
+		if fi.Value != fj.Value {
+			return fi.Value > fj.Value
+		}
+		//tie-break for deterministic output
+		if fi.SecurityGroupID != fj.SecurityGroupID {
+			return fi.SecurityGroupID < fj.SecurityGroupID
+		}
+		return fi.RemoteSecurityGroupID < fj.RemoteSecurityGroupID
+	})
+	if len(factors) > n {
+		factors = factors[:n]
+	}
+	return factors
+}
@@ -0,0 +1,120 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Builds the example project from the README, and a second project whose
+//"svc" group (with 5 ports) is shared via RBAC and referenced by the app
+//servers' group in the example project. The second project also has an
+//unrelated "client" group.
+func exampleProjectsWithForeignReference() map[string]*Project {
+	example := exampleProject()
+	example.Groups["app"].ForeignReferenceCount["svc"] = 1
+
+	shared := &Project{UUID: "shared", Groups: map[string]*SecurityGroup{
+		"svc":    newSecurityGroup("svc", "svc-name", 5),
+		"client": newSecurityGroup("client", "client-name", 3),
+	}}
+	return map[string]*Project{"example": example, "shared": shared}
+}
+
+func TestPartitionAllSecurityGroups(t *testing.T) {
+	partitions := PartitionAllSecurityGroups(exampleProjectsWithForeignReference())
+
+	//the partitions are ordered by project, so the merged partition comes first
+	var groupIDs [][]string
+	for _, partition := range partitions {
+		groupIDs = append(groupIDs, partition.SortedGroupIDs())
+	}
+	expected := [][]string{{"app", "db", "default", "jump", "svc"}, {"client"}}
+	if !reflect.DeepEqual(groupIDs, expected) {
+		t.Fatalf("expected partitions %v, got %v", expected, groupIDs)
+	}
+	//the reference to "svc" adds its 5 ports to the score
+	if actual := partitions[0].Score().Value; actual != 19 {
+		t.Errorf("expected score 19 for the merged partition, got %d", actual)
+	}
+
+	//the ID only depends on the membership, not on how the partition was built
+	merged := make(Partition)
+	for _, project := range exampleProjectsWithForeignReference() {
+		for groupID, group := range project.Groups {
+			if groupID != "client" {
+				merged[groupID] = group
+			}
+		}
+	}
+	if partitions[0].ID() != merged.ID() {
+		t.Errorf("expected partition ID %s, got %s", merged.ID(), partitions[0].ID())
+	}
+	expectedIDs := partitionIDs(partitions)
+	for run := 0; run < 10; run++ {
+		actualIDs := partitionIDs(PartitionAllSecurityGroups(exampleProjectsWithForeignReference()))
+		if !reflect.DeepEqual(actualIDs, expectedIDs) {
+			t.Fatalf("expected partition IDs %v, got %v", expectedIDs, actualIDs)
+		}
+	}
+
+	//without the cross-project reference, nothing is merged
+	projects := exampleProjectsWithForeignReference()
+	delete(projects["example"].Groups["app"].ForeignReferenceCount, "svc")
+	if actual := len(PartitionAllSecurityGroups(projects)); actual != 3 {
+		t.Errorf("expected 3 partitions without the cross-project reference, got %d", actual)
+	}
+}
+
+func TestNewReportWithForeignReference(t *testing.T) {
+	report := NewReport(exampleProjectsWithForeignReference(), time.Unix(0, 0))
+	example, shared := report.Projects["example"], report.Projects["shared"]
+
+	//both projects report the merged partition under the same ID
+	if actual := example.partitionScoreValues(); !reflect.DeepEqual(actual, []uint64{19}) {
+		t.Errorf("expected partition scores [19] in project example, got %v", actual)
+	}
+	if actual := shared.partitionScoreValues(); !reflect.DeepEqual(actual, []uint64{19, 0}) {
+		t.Errorf("expected partition scores [19 0] in project shared, got %v", actual)
+	}
+	if len(example.Partitions) > 0 && len(shared.Partitions) > 0 {
+		exampleID, sharedID := example.Partitions[0].Partition.ID(), shared.Partitions[0].Partition.ID()
+		if exampleID != sharedID {
+			t.Errorf("expected the same partition in both projects, got %s and %s", exampleID, sharedID)
+		}
+	}
+	if example.MaxScore != 19 || shared.MaxScore != 19 {
+		t.Errorf("expected max score 19 in both projects, got %d and %d", example.MaxScore, shared.MaxScore)
+	}
+	if example.SecurityGroup("svc") == nil {
+		t.Error("expected project example to find the foreign group svc in its partitions")
+	}
+
+	//without "svc", the partition has the score 14 of the example project; and
+	//without the example project's groups, "svc" alone has a score of 0
+	if expected := map[string]uint64{"shared": 5}; !reflect.DeepEqual(example.ForeignScores, expected) {
+		t.Errorf("expected foreign scores %v in project example, got %v", expected, example.ForeignScores)
+	}
+	if expected := map[string]uint64{"example": 19}; !reflect.DeepEqual(shared.ForeignScores, expected) {
+		t.Errorf("expected foreign scores %v in project shared, got %v", expected, shared.ForeignScores)
+	}
+}
@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+//DatabaseSchema describes the parts of the Neutron DB schema that change
+//between Neutron versions.
+type DatabaseSchema struct {
+	//Either "project_id" (since Newton) or "tenant_id".
+	ProjectIDColumnName string
+	//Whether address groups exist (since Wallaby).
+	HasAddressGroups bool
+	//Whether the ml2_port_bindings table exists (i.e. the ML2 plugin is used).
+	HasPortBindings bool
+	//Whether ports can have multiple bindings, of which only the one with
+	//status "ACTIVE" is in use (since Pike).
+	HasPortBindingStatus bool
+}
+
+//DatabaseSchemaForRelease returns the DatabaseSchema of the given Neutron
+//release (e.g. "queens").
+func DatabaseSchemaForRelease(release string) (DatabaseSchema, error) {
+	switch release {
+	case "kilo", "liberty", "mitaka":
+		return DatabaseSchema{ProjectIDColumnName: "tenant_id", HasPortBindings: true}, nil
+	case "newton", "ocata":
+		return DatabaseSchema{ProjectIDColumnName: "project_id", HasPortBindings: true}, nil
+	case "pike", "queens", "rocky", "stein", "train", "ussuri", "victoria":
+		return DatabaseSchema{ProjectIDColumnName: "project_id", HasPortBindings: true, HasPortBindingStatus: true}, nil
+	case "wallaby", "xena", "yoga", "zed":
+		return DatabaseSchema{ProjectIDColumnName: "project_id", HasAddressGroups: true, HasPortBindings: true, HasPortBindingStatus: true}, nil
+	default:
+		return DatabaseSchema{}, fmt.Errorf("unknown Neutron release: %q", release)
+	}
+}
+
+//Lists the columns of all tables whose presence differs between Neutron
+//versions. This query is also written in the PostgreSQL dialect, but
+//does not need the DatabaseSchema to be applied.
+var schemaColumnsQuery = `
+	SELECT table_name, column_name
+	  FROM information_schema.columns
+	 WHERE table_schema = current_schema()
+	   AND table_name IN ('securitygroups', 'securitygrouprules', 'address_associations', 'ml2_port_bindings');
+`
+
+//DetectDatabaseSchema inspects the Neutron DB to find out its DatabaseSchema.
+//Only cfg.Dialect and cfg.QueryTimeout are used.
+func DetectDatabaseSchema(ctx context.Context, db *sql.DB, cfg Config) (DatabaseSchema, error) {
+	var (
+		schema     DatabaseSchema
+		tableName  string
+		columnName string
+	)
+	columns := make(map[string]bool) //key = "table.column"
+	tables := make(map[string]bool)
+	q := queryRunner{ctx, db, cfg.QueryTimeout}
+	err := q.scan("schema_columns", cfg.Dialect.Rebind(schemaColumnsQuery), args(&tableName, &columnName), func() {
+		columns[tableName+"."+columnName] = true
+		tables[tableName] = true
+	})
+	if err != nil {
+		return schema, err
+	}
+
+	switch {
+	case columns["securitygroups.project_id"]:
+		schema.ProjectIDColumnName = "project_id"
+	case columns["securitygroups.tenant_id"]:
+		schema.ProjectIDColumnName = "tenant_id"
+	default:
+		return schema, fmt.Errorf("cannot detect Neutron DB schema: no project ID column found in table securitygroups")
+	}
+	schema.HasAddressGroups = tables["address_associations"] && columns["securitygrouprules.remote_address_group_id"]
+	schema.HasPortBindings = tables["ml2_port_bindings"]
+	schema.HasPortBindingStatus = columns["ml2_port_bindings.status"]
+
+	return schema, nil
+}
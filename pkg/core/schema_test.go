@@ -0,0 +1,220 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatabaseSchemaForRelease(t *testing.T) {
+	kilo := DatabaseSchema{ProjectIDColumnName: "tenant_id", HasPortBindings: true}
+	newton := DatabaseSchema{ProjectIDColumnName: "project_id", HasPortBindings: true}
+	pike := DatabaseSchema{ProjectIDColumnName: "project_id", HasPortBindings: true, HasPortBindingStatus: true}
+	wallaby := DatabaseSchema{ProjectIDColumnName: "project_id", HasAddressGroups: true, HasPortBindings: true, HasPortBindingStatus: true}
+	testCases := map[string]DatabaseSchema{
+		"kilo":     kilo,
+		"liberty":  kilo,
+		"mitaka":   kilo,
+		"newton":   newton,
+		"ocata":    newton,
+		"pike":     pike,
+		"queens":   pike,
+		"rocky":    pike,
+		"stein":    pike,
+		"train":    pike,
+		"ussuri":   pike,
+		"victoria": pike,
+		"wallaby":  wallaby,
+		"xena":     wallaby,
+		"yoga":     wallaby,
+		"zed":      wallaby,
+	}
+	for release, expected := range testCases {
+		actual, err := DatabaseSchemaForRelease(release)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", release, err.Error())
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%s: expected schema %#v, got %#v", release, expected, actual)
+		}
+	}
+
+	for _, release := range []string{"", "juno", "Queens", "2023.1"} {
+		_, err := DatabaseSchemaForRelease(release)
+		if err == nil {
+			t.Errorf("%q: expected error, got nil", release)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//fake database driver
+
+//schemaTestDriver is a database/sql driver that answers every query with the
+//rows stored under the data source name in schemaTestColumns.
+type schemaTestDriver struct{}
+
+//key = data source name, value = list of "table.column"
+var schemaTestColumns = make(map[string][]string)
+
+func init() {
+	sql.Register("schematest", schemaTestDriver{})
+}
+
+func (schemaTestDriver) Open(name string) (driver.Conn, error) {
+	columns, exists := schemaTestColumns[name]
+	if !exists {
+		return nil, errors.New("no such test database: " + name)
+	}
+	return schemaTestConn{columns}, nil
+}
+
+type schemaTestConn struct {
+	columns []string
+}
+
+func (c schemaTestConn) Prepare(query string) (driver.Stmt, error) {
+	return schemaTestStmt(c), nil
+}
+
+func (schemaTestConn) Close() error {
+	return nil
+}
+
+func (schemaTestConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type schemaTestStmt schemaTestConn
+
+func (schemaTestStmt) Close() error {
+	return nil
+}
+
+func (schemaTestStmt) NumInput() int {
+	return 0
+}
+
+func (schemaTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("statements are not supported")
+}
+
+func (s schemaTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &schemaTestRows{columns: s.columns}, nil
+}
+
+type schemaTestRows struct {
+	columns []string
+}
+
+func (*schemaTestRows) Columns() []string {
+	return []string{"table_name", "column_name"}
+}
+
+func (*schemaTestRows) Close() error {
+	return nil
+}
+
+func (r *schemaTestRows) Next(dest []driver.Value) error {
+	if len(r.columns) == 0 {
+		return io.EOF
+	}
+	fields := strings.SplitN(r.columns[0], ".", 2)
+	dest[0], dest[1] = fields[0], fields[1]
+	r.columns = r.columns[1:]
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//DetectDatabaseSchema
+
+func TestDetectDatabaseSchema(t *testing.T) {
+	testCases := map[string]struct {
+		Columns  []string
+		Expected DatabaseSchema
+	}{
+		"kilo": {
+			Columns:  []string{"securitygroups.tenant_id", "securitygrouprules.tenant_id", "ml2_port_bindings.port_id"},
+			Expected: DatabaseSchema{ProjectIDColumnName: "tenant_id", HasPortBindings: true},
+		},
+		"queens": {
+			Columns:  []string{"securitygroups.project_id", "securitygrouprules.project_id", "ml2_port_bindings.port_id", "ml2_port_bindings.status"},
+			Expected: DatabaseSchema{ProjectIDColumnName: "project_id", HasPortBindings: true, HasPortBindingStatus: true},
+		},
+		"zed": {
+			Columns: []string{
+				"securitygroups.project_id", "securitygrouprules.project_id", "securitygrouprules.remote_address_group_id",
+				"address_associations.address_group_id", "ml2_port_bindings.port_id", "ml2_port_bindings.status",
+			},
+			Expected: DatabaseSchema{ProjectIDColumnName: "project_id", HasAddressGroups: true, HasPortBindings: true, HasPortBindingStatus: true},
+		},
+		"zed-without-ml2": {
+			Columns: []string{
+				"securitygroups.project_id", "securitygrouprules.remote_address_group_id", "address_associations.address_group_id",
+			},
+			Expected: DatabaseSchema{ProjectIDColumnName: "project_id", HasAddressGroups: true},
+		},
+		//address groups need both the table and the column in the rules table
+		"incomplete-address-groups": {
+			Columns:  []string{"securitygroups.project_id", "address_associations.address_group_id"},
+			Expected: DatabaseSchema{ProjectIDColumnName: "project_id"},
+		},
+	}
+
+	cfg := Config{Dialect: postgresDialect{}, QueryTimeout: 10 * time.Second}
+	for name, tc := range testCases {
+		schemaTestColumns[name] = tc.Columns
+		db, err := sql.Open("schematest", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := DetectDatabaseSchema(context.Background(), db, cfg)
+		db.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if actual != tc.Expected {
+			t.Errorf("%s: expected schema %#v, got %#v", name, tc.Expected, actual)
+		}
+	}
+}
+
+func TestDetectDatabaseSchemaWithoutProjectID(t *testing.T) {
+	schemaTestColumns["unknown"] = []string{"securitygroups.name", "ml2_port_bindings.port_id"}
+	db, err := sql.Open("schematest", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = DetectDatabaseSchema(context.Background(), db, Config{Dialect: postgresDialect{}, QueryTimeout: 10 * time.Second})
+	if err == nil || !strings.Contains(err.Error(), "no project ID column") {
+		t.Errorf("expected error about missing project ID column, got %v", err)
+	}
+}
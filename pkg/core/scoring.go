@@ -0,0 +1,238 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+//Scorer is a model for computing entanglement scores. The default model is
+//returned by DefaultScorer(). Other models can be selected with
+//UseScorer().
+type Scorer interface {
+	//Name identifies the scoring model, e.g. in the
+	//secgroup_entanglement_scoring_model_info metric.
+	Name() string
+	//Score computes the entanglement score of the given partition. Most
+	//implementations will want to start from groups.BaseFactors().
+	Score(groups Partition) Score
+}
+
+//The scorer used by Partition.Score().
+var activeScorer = DefaultScorer()
+
+//UseScorer selects the scoring model that is used by Partition.Score(). This
+//must be called before any partitions are scored since reports that were
+//computed with different models cannot be compared.
+func UseScorer(s Scorer) {
+	activeScorer = s
+}
+
+//ActiveScorer returns the scorer that was selected by UseScorer().
+func ActiveScorer() Scorer {
+	return activeScorer
+}
+
+//DefaultScorer returns the default scoring model, which counts 1 per pair of
+//groups shared by ports and `PortCount * ReferenceCount` per remote reference.
+//Combinations of groups used by ports (PortCombinationsFactor) are not
+//counted since that would raise all scores compared to earlier versions; they
+//can be weighted in a scoring config file instead (see ReadScorerFile).
+func DefaultScorer() Scorer {
+	return WeightedScorer{ModelName: "default"}
+}
+
+//WeightedScorer is a Scorer that transforms each factor returned by
+//Partition.BaseFactors() into `min(Cap, Weight * value^Exponent)`, with
+//separate parameters for each kind of factor.
+type WeightedScorer struct {
+	ModelName string                      `json:"name"`
+	Factors   map[FactorKind]FactorWeight `json:"factors"`
+	//If true, the value of each AddressGroupReferenceFactor is multiplied by
+	//the number of addresses in the referenced address group (before
+	//applying the FactorWeight).
+	WeighAddressGroupsBySize bool `json:"weigh_address_groups_by_size"`
+}
+
+//Factors describing rules that do not connect security groups with each other
+//are ignored unless a weight is configured for them. The same goes for port
+//combinations, which are an opt-in alternative to counting shared ports.
+var defaultFactorWeights = map[FactorKind]float64{
+	PortCombinationsFactor:      0,
+	IPPrefixRulesFactor:         0,
+	AddressGroupReferenceFactor: 0,
+}
+
+//FactorWeight contains the parameters of a WeightedScorer for one kind of
+//factor.
+type FactorWeight struct {
+	//Default: 0 for port_combinations, ip_prefix_rules and
+	//address_group_reference, 1 for all other kinds. Set to 0 to ignore
+	//factors of this kind.
+	Weight *float64 `json:"weight"`
+	//Default: 1.
+	Exponent *float64 `json:"exponent"`
+	//Default: 0 (no cap).
+	Cap uint64 `json:"cap"`
+}
+
+//Name implements the Scorer interface.
+func (s WeightedScorer) Name() string {
+	return s.ModelName
+}
+
+//Score implements the Scorer interface.
+func (s WeightedScorer) Score(groups Partition) (result Score) {
+	for _, factor := range groups.BaseFactors() {
+		if factor.Kind == AddressGroupReferenceFactor && s.WeighAddressGroupsBySize {
+			factor.Value *= groups[factor.SecurityGroupID].AddressGroupReferences[factor.RemoteAddressGroupID].AddressCount
+		}
+		factor.Value = s.Factors[factor.Kind].apply(factor.Kind, factor.Value)
+		if factor.Value > 0 {
+			result.Factors = append(result.Factors, factor)
+		}
+	}
+	for _, factor := range result.Factors {
+		result.Value += factor.Value
+	}
+	return result
+}
+
+func (w FactorWeight) apply(kind FactorKind, value uint64) uint64 {
+	weight, exists := defaultFactorWeights[kind]
+	if !exists {
+		weight = 1
+	}
+	if w.Weight != nil {
+		weight = *w.Weight
+	}
+	if weight == 1 && w.Exponent == nil && w.Cap == 0 {
+		return value //fast path for the default model
+	}
+
+	x := float64(value)
+	if w.Exponent != nil {
+		x = math.Pow(x, *w.Exponent)
+	}
+	x *= weight
+	x = math.Round(x)
+	if w.Cap > 0 && x > float64(w.Cap) {
+		return w.Cap
+	}
+	if x >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(x)
+}
+
+func (s WeightedScorer) validate() error {
+	if s.ModelName == "" {
+		return fmt.Errorf("missing model name")
+	}
+
+	kinds := make([]string, 0, len(s.Factors))
+	for kind := range s.Factors {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		if !isKnownFactorKind(FactorKind(kind)) {
+			return fmt.Errorf("unknown factor kind: %q", kind)
+		}
+		w := s.Factors[FactorKind(kind)]
+		if w.Weight != nil && !(*w.Weight >= 0) {
+			return fmt.Errorf("invalid weight for %s: %g", kind, *w.Weight)
+		}
+		if w.Exponent != nil && !(*w.Exponent > 0) {
+			return fmt.Errorf("invalid exponent for %s: %g", kind, *w.Exponent)
+		}
+	}
+	return nil
+}
+
+func isKnownFactorKind(kind FactorKind) bool {
+	for _, k := range AllFactorKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+//scorerTypes contains constructors for all scoring models that can be
+//selected in a scoring config file (see ReadScorerFile).
+var scorerTypes = map[string]func(buf []byte) (Scorer, error){
+	"weighted": func(buf []byte) (Scorer, error) {
+		var data struct {
+			Type string `json:"type"`
+			WeightedScorer
+		}
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&data)
+		if err != nil {
+			return nil, err
+		}
+		return data.WeightedScorer, data.WeightedScorer.validate()
+	},
+}
+
+//ReadScorerFile reads a scoring model from a JSON file like
+//
+//    {
+//      "type": "weighted",
+//      "name": "dvs",
+//      "factors": {
+//        "shared_ports": { "weight": 10 },
+//        "remote_reference": { "exponent": 1.5, "cap": 10000 }
+//      }
+//    }
+//
+//The "type" selects the Scorer implementation, and all other fields are
+//specific to that implementation.
+func ReadScorerFile(path string) (Scorer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(buf, &header)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode scoring model from %s: %s", path, err.Error())
+	}
+	constructor, exists := scorerTypes[header.Type]
+	if !exists {
+		return nil, fmt.Errorf("cannot read scoring model from %s: unknown type %q", path, header.Type)
+	}
+	s, err := constructor(buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read scoring model from %s: %s", path, err.Error())
+	}
+	return s, nil
+}
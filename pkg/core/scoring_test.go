@@ -0,0 +1,130 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScorerFile(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "scoring.json")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//Like exampleProject, but with rules referencing CIDRs and address groups.
+func exampleProjectWithRules() *Project {
+	p := exampleProject()
+	p.Groups["default"].IPPrefixRuleCount = 3
+	p.Groups["jump"].AddressGroupReferences["admins"] = &AddressGroupReference{RuleCount: 2, AddressCount: 5}
+	return p
+}
+
+func checkFactorValues(t *testing.T, score Score, expected map[FactorKind]uint64) {
+	t.Helper()
+	for _, kind := range AllFactorKinds {
+		if actual := score.ValueByKind(kind); actual != expected[kind] {
+			t.Errorf("expected %s = %d, got %d", kind, expected[kind], actual)
+		}
+	}
+}
+
+func TestDefaultScorer(t *testing.T) {
+	partition := onlyPartition(t, exampleProjectWithRules())
+	score := DefaultScorer().Score(partition)
+	if score.Value != 14 {
+		t.Errorf("expected score 14, got %d", score.Value)
+	}
+	//port combinations and rules referencing CIDRs or address groups are not
+	//counted by default
+	checkFactorValues(t, score, map[FactorKind]uint64{
+		SharedPortsFactor:     2,
+		RemoteReferenceFactor: 12,
+	})
+}
+
+func TestReadScorerFile(t *testing.T) {
+	path := writeScorerFile(t, `{
+		"type": "weighted",
+		"name": "test",
+		"factors": {
+			"shared_ports": { "weight": 10 },
+			"port_combinations": { "weight": 3 },
+			"remote_reference": { "exponent": 2, "cap": 50 },
+			"ip_prefix_rules": { "weight": 0.5 },
+			"address_group_reference": { "weight": 1 }
+		},
+		"weigh_address_groups_by_size": true
+	}`)
+	s, err := ReadScorerFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "test" {
+		t.Errorf("expected model name %q, got %q", "test", s.Name())
+	}
+
+	score := s.Score(onlyPartition(t, exampleProjectWithRules()))
+	checkFactorValues(t, score, map[FactorKind]uint64{
+		SharedPortsFactor:      2 * 10,
+		PortCombinationsFactor: 2 * 3,
+		//2^2 for the jump servers, and 10^2 (capped to 50) for the app servers
+		RemoteReferenceFactor: 4 + 50,
+		//1.5 rounded
+		IPPrefixRulesFactor: 2,
+		//2 rules referencing 5 addresses
+		AddressGroupReferenceFactor: 10,
+	})
+	if score.Value != 20+6+54+2+10 {
+		t.Errorf("expected score %d, got %d", 20+6+54+2+10, score.Value)
+	}
+}
+
+func TestReadScorerFileRejectsInvalidConfig(t *testing.T) {
+	testCases := map[string]string{
+		`{"type":"weighted","name":"test","factors":{"shared_port":{"weight":2}}}`:        `unknown factor kind: "shared_port"`,
+		`{"type":"linear","name":"test"}`:                                                 `unknown type "linear"`,
+		`{"type":"weighted","name":"test","factor":{}}`:                                   `unknown field "factor"`,
+		`{"type":"weighted","factors":{}}`:                                                `missing model name`,
+		`{"type":"weighted","name":"test","factors":{"shared_ports":{"weight":-1}}}`:      `invalid weight for shared_ports`,
+		`{"type":"weighted","name":"test","factors":{"remote_reference":{"exponent":0}}}`: `invalid exponent for remote_reference`,
+	}
+	for content, expectedMessage := range testCases {
+		_, err := ReadScorerFile(writeScorerFile(t, content))
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", content)
+		} else if !strings.Contains(err.Error(), expectedMessage) {
+			t.Errorf("%s: expected error containing %q, got %q", content, expectedMessage, err.Error())
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+)
+
+//MutationKind identifies the type of change described by a Mutation.
+type MutationKind string
+
+const (
+	//RemoveReferences removes `Count` rules (or all rules if Count is 0) in
+	//group `SecurityGroupID` that reference group `RemoteSecurityGroupID`.
+	RemoveReferences MutationKind = "remove_references"
+	//AddReferences adds `Count` rules (at least 1) to group `SecurityGroupID`
+	//that reference group `RemoteSecurityGroupID`.
+	AddReferences MutationKind = "add_references"
+	//AddPorts adds `Count` ports (at least 1) that are in all the groups
+	//listed in `SecurityGroupIDs`.
+	AddPorts MutationKind = "add_ports"
+	//RemovePorts removes `Count` ports (at least 1) that are in all the groups
+	//listed in `SecurityGroupIDs`.
+	RemovePorts MutationKind = "remove_ports"
+	//MovePorts removes `Count` ports (at least 1) that are in all the groups
+	//listed in `SecurityGroupIDs`, and adds them to all the groups listed in
+	//`TargetSecurityGroupIDs` instead.
+	MovePorts MutationKind = "move_ports"
+	//DeleteGroup deletes the group `SecurityGroupID`. Its ports remain in
+	//their other groups, and rules referencing it are deleted.
+	DeleteGroup MutationKind = "delete_group"
+)
+
+//Mutation describes a hypothetical change to a project's security groups.
+//Which fields are used depends on the Kind.
+type Mutation struct {
+	Kind                   MutationKind `json:"kind"`
+	SecurityGroupID        string       `json:"security_group_id,omitempty"`
+	RemoteSecurityGroupID  string       `json:"remote_security_group_id,omitempty"`
+	SecurityGroupIDs       []string     `json:"security_group_ids,omitempty"`
+	TargetSecurityGroupIDs []string     `json:"target_security_group_ids,omitempty"`
+	Count                  uint64       `json:"count,omitempty"`
+}
+
+//SimulationResult contains the partitions and scores of a project before
+//and after a set of mutations was applied.
+type SimulationResult struct {
+	Before *ProjectReport
+	After  *ProjectReport
+}
+
+//Simulate applies the given mutations to a copy of the given project (the
+//original is not changed) and scores the project before and after.
+//
+//Since the project only contains aggregated port counts, port mutations are
+//approximated: Removing ports from a set of groups decrements the port counts
+//of these groups, the shared port counts of each pair of them, and the port
+//count of the combination of exactly these groups.
+func Simulate(project *Project, mutations []Mutation) (*SimulationResult, error) {
+	mutated := project.Clone()
+	for idx, m := range mutations {
+		err := mutated.apply(m)
+		if err != nil {
+			return nil, fmt.Errorf("cannot apply mutation %d (%s): %s", idx+1, m.Kind, err.Error())
+		}
+	}
+
+	return &SimulationResult{
+		Before: NewProjectReport(project),
+		After:  NewProjectReport(mutated),
+	}, nil
+}
+
+//Clone returns a deep copy of this project.
+func (p Project) Clone() *Project {
+	result := &Project{
+		UUID:   p.UUID,
+		Groups: make(map[string]*SecurityGroup, len(p.Groups)),
+	}
+	for groupID, group := range p.Groups {
+		clone := *group
+		clone.SharedPortCount = make(map[string]uint64, len(group.SharedPortCount))
+		for k, v := range group.SharedPortCount {
+			clone.SharedPortCount[k] = v
+		}
+		clone.ReferenceCount = make(map[string]uint64, len(group.ReferenceCount))
+		for k, v := range group.ReferenceCount {
+			clone.ReferenceCount[k] = v
+		}
+		clone.PortCombinations = make(map[string]uint64, len(group.PortCombinations))
+		for k, v := range group.PortCombinations {
+			clone.PortCombinations[k] = v
+		}
+		clone.AddressGroupReferences = make(map[string]*AddressGroupReference, len(group.AddressGroupReferences))
+		for k, v := range group.AddressGroupReferences {
+			ref := *v
+			clone.AddressGroupReferences[k] = &ref
+		}
+		clone.ForeignSharedPortCount = make(map[string]uint64, len(group.ForeignSharedPortCount))
+		for k, v := range group.ForeignSharedPortCount {
+			clone.ForeignSharedPortCount[k] = v
+		}
+		clone.ForeignReferenceCount = make(map[string]uint64, len(group.ForeignReferenceCount))
+		for k, v := range group.ForeignReferenceCount {
+			clone.ForeignReferenceCount[k] = v
+		}
+		clone.ForeignPortCombinations = make(map[string]uint64, len(group.ForeignPortCombinations))
+		for k, v := range group.ForeignPortCombinations {
+			clone.ForeignPortCombinations[k] = v
+		}
+		clone.HostPortCombinations = make(map[string]map[string]uint64, len(group.HostPortCombinations))
+		for host, portCounts := range group.HostPortCombinations {
+			clone.HostPortCombinations[host] = make(map[string]uint64, len(portCounts))
+			for k, v := range portCounts {
+				clone.HostPortCombinations[host][k] = v
+			}
+		}
+		result.Groups[groupID] = &clone
+	}
+	return result
+}
+
+func (p *Project) apply(m Mutation) error {
+	count := m.Count
+	if count == 0 && m.Kind != RemoveReferences {
+		count = 1
+	}
+
+	switch m.Kind {
+	case RemoveReferences, AddReferences:
+		group, err := p.findGroup(m.SecurityGroupID)
+		if err != nil {
+			return err
+		}
+		_, err = p.findGroup(m.RemoteSecurityGroupID)
+		if err != nil {
+			return err
+		}
+		if m.Kind == AddReferences {
+			group.ReferenceCount[m.RemoteSecurityGroupID] += count
+		} else if count == 0 || group.ReferenceCount[m.RemoteSecurityGroupID] <= count {
+			delete(group.ReferenceCount, m.RemoteSecurityGroupID)
+		} else {
+			group.ReferenceCount[m.RemoteSecurityGroupID] -= count
+		}
+		return nil
+
+	case AddPorts:
+		return p.addPorts(m.SecurityGroupIDs, count)
+
+	case RemovePorts:
+		return p.removePorts(m.SecurityGroupIDs, count)
+
+	case MovePorts:
+		err := p.removePorts(m.SecurityGroupIDs, count)
+		if err != nil {
+			return err
+		}
+		return p.addPorts(m.TargetSecurityGroupIDs, count)
+
+	case DeleteGroup:
+		_, err := p.findGroup(m.SecurityGroupID)
+		if err != nil {
+			return err
+		}
+		p.deleteGroup(m.SecurityGroupID)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown mutation kind: %q", m.Kind)
+	}
+}
+
+func (p *Project) deleteGroup(groupID string) {
+	//the ports in each combination including this group remain in the other
+	//groups of the combination
+	for key, portCount := range p.Groups[groupID].PortCombinations {
+		var remainingGroupIDs []string
+		for _, otherGroupID := range CombinationGroupIDs(key) {
+			if otherGroupID != groupID {
+				remainingGroupIDs = append(remainingGroupIDs, otherGroupID)
+			}
+		}
+		p.setCombinationPortCount(key, 0)
+		if len(remainingGroupIDs) > 1 {
+			remainingKey := CombinationKey(remainingGroupIDs)
+			p.setCombinationPortCount(remainingKey, p.Groups[remainingGroupIDs[0]].PortCombinations[remainingKey]+portCount)
+		}
+	}
+
+	delete(p.Groups, groupID)
+	for _, group := range p.Groups {
+		delete(group.SharedPortCount, groupID)
+		delete(group.ReferenceCount, groupID)
+		delete(group.ForeignSharedPortCount, groupID)
+		delete(group.ForeignReferenceCount, groupID)
+	}
+}
+
+func (p *Project) findGroup(groupID string) (*SecurityGroup, error) {
+	if groupID == "" {
+		return nil, fmt.Errorf("missing security group ID")
+	}
+	group, exists := p.Groups[groupID]
+	if !exists {
+		return nil, fmt.Errorf("no security group with ID %q in project %s", groupID, p.UUID)
+	}
+	return group, nil
+}
+
+func (p *Project) addPorts(groupIDs []string, count uint64) error {
+	groups, err := p.findGroups(groupIDs)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		group.PortCount += count
+		for _, otherGroup := range groups {
+			if group != otherGroup {
+				group.SharedPortCount[otherGroup.UUID] += count
+			}
+		}
+	}
+	if len(groups) > 1 {
+		key := combinationKeyOf(groups)
+		p.setCombinationPortCount(key, groups[0].PortCombinations[key]+count)
+	}
+	return nil
+}
+
+func (p *Project) removePorts(groupIDs []string, count uint64) error {
+	groups, err := p.findGroups(groupIDs)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		group.PortCount = saturatingSub(group.PortCount, count)
+		for _, otherGroup := range groups {
+			if group == otherGroup {
+				continue
+			}
+			group.SharedPortCount[otherGroup.UUID] = saturatingSub(group.SharedPortCount[otherGroup.UUID], count)
+			if group.SharedPortCount[otherGroup.UUID] == 0 {
+				delete(group.SharedPortCount, otherGroup.UUID)
+			}
+		}
+	}
+	if len(groups) > 1 {
+		key := combinationKeyOf(groups)
+		p.setCombinationPortCount(key, saturatingSub(groups[0].PortCombinations[key], count))
+	}
+	return nil
+}
+
+func (p *Project) findGroups(groupIDs []string) ([]*SecurityGroup, error) {
+	if len(groupIDs) == 0 {
+		return nil, fmt.Errorf("missing security group IDs")
+	}
+	groups := make([]*SecurityGroup, 0, len(groupIDs))
+	seen := make(map[string]bool, len(groupIDs))
+	for _, groupID := range groupIDs {
+		if seen[groupID] {
+			continue
+		}
+		seen[groupID] = true
+		group, err := p.findGroup(groupID)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func combinationKeyOf(groups []*SecurityGroup) string {
+	groupIDs := make([]string, len(groups))
+	for idx, group := range groups {
+		groupIDs[idx] = group.UUID
+	}
+	return CombinationKey(groupIDs)
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
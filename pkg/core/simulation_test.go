@@ -0,0 +1,152 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+//Builds the example project from the README: 10 app servers and 1 DB server
+//that are also in the default group, 2 jump servers, and rules in the default
+//group (referencing the jump servers) and in the database group (referencing
+//the app servers). Its only partition has a score of 14.
+func exampleProject() *Project {
+	p := &Project{UUID: "example", Groups: make(map[string]*SecurityGroup)}
+	for _, groupID := range []string{"app", "db", "default", "jump"} {
+		p.Groups[groupID] = newSecurityGroup(groupID, groupID+"-name", 0)
+	}
+	p.addPorts([]string{"app", "default"}, 10)
+	p.addPorts([]string{"db", "default"}, 1)
+	p.addPorts([]string{"jump"}, 2)
+	p.Groups["default"].ReferenceCount["jump"] = 1
+	p.Groups["db"].ReferenceCount["app"] = 1
+	return p
+}
+
+//Returns the scores of the partitions in this report (in the order of
+//Project.PartitionSecurityGroups).
+func (pr ProjectReport) partitionScoreValues() []uint64 {
+	result := make([]uint64, len(pr.Partitions))
+	for idx, part := range pr.Partitions {
+		result[idx] = part.Score.Value
+	}
+	return result
+}
+
+func TestSimulate(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		Mutation       Mutation
+		ExpectedScores []uint64
+	}{
+		{
+			//the fix described in the README
+			Name:           "remove rule",
+			Mutation:       Mutation{Kind: RemoveReferences, SecurityGroupID: "db", RemoteSecurityGroupID: "app"},
+			ExpectedScores: []uint64{4},
+		},
+		{
+			Name:           "add rule",
+			Mutation:       Mutation{Kind: AddReferences, SecurityGroupID: "jump", RemoteSecurityGroupID: "db", Count: 2},
+			ExpectedScores: []uint64{16},
+		},
+		{
+			//adds 1 shared pair and 1 port behind the rule referencing "jump"
+			Name:           "add port to groups",
+			Mutation:       Mutation{Kind: AddPorts, SecurityGroupIDs: []string{"jump", "default"}},
+			ExpectedScores: []uint64{16},
+		},
+		{
+			//removes 1 of the 10 ports behind the rule referencing "app"
+			Name:           "remove port from groups",
+			Mutation:       Mutation{Kind: RemovePorts, SecurityGroupIDs: []string{"app", "default"}},
+			ExpectedScores: []uint64{13},
+		},
+		{
+			//"jump" is only connected to the other groups through "default"
+			Name:           "delete group",
+			Mutation:       Mutation{Kind: DeleteGroup, SecurityGroupID: "default"},
+			ExpectedScores: []uint64{10, 0},
+		},
+		{
+			//the DB server is no longer shared with "default"
+			Name:           "move ports",
+			Mutation:       Mutation{Kind: MovePorts, SecurityGroupIDs: []string{"db", "default"}, TargetSecurityGroupIDs: []string{"db"}},
+			ExpectedScores: []uint64{13},
+		},
+	}
+
+	for _, tc := range testCases {
+		project := exampleProject()
+		result, err := Simulate(project, []Mutation{tc.Mutation})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.Name, err.Error())
+			continue
+		}
+		if scores := result.Before.partitionScoreValues(); !reflect.DeepEqual(scores, []uint64{14}) {
+			t.Errorf("%s: expected partition scores [14] before, got %v", tc.Name, scores)
+		}
+		if scores := result.After.partitionScoreValues(); !reflect.DeepEqual(scores, tc.ExpectedScores) {
+			t.Errorf("%s: expected partition scores %v after, got %v", tc.Name, tc.ExpectedScores, scores)
+		}
+		if !reflect.DeepEqual(project, exampleProject()) {
+			t.Errorf("%s: original project was modified", tc.Name)
+		}
+	}
+}
+
+func TestSimulateUpdatesPortCounts(t *testing.T) {
+	result, err := Simulate(exampleProject(), []Mutation{
+		{Kind: MovePorts, SecurityGroupIDs: []string{"app", "default"}, TargetSecurityGroupIDs: []string{"app", "jump"}, Count: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := result.After.Project.Groups
+	expectedPortCounts := map[string]uint64{"app": 10, "db": 1, "default": 8, "jump": 5}
+	for groupID, expected := range expectedPortCounts {
+		if actual := groups[groupID].PortCount; actual != expected {
+			t.Errorf("expected %d ports in %s, got %d", expected, groupID, actual)
+		}
+	}
+	if actual := groups["app"].SharedPortCount; !reflect.DeepEqual(actual, map[string]uint64{"default": 7, "jump": 3}) {
+		t.Errorf("unexpected shared port counts for app: %v", actual)
+	}
+	keyAppDefault, keyAppJump := CombinationKey([]string{"app", "default"}), CombinationKey([]string{"app", "jump"})
+	if actual := groups["app"].PortCombinations; !reflect.DeepEqual(actual, map[string]uint64{keyAppDefault: 7, keyAppJump: 3}) {
+		t.Errorf("unexpected port combinations for app: %v", actual)
+	}
+}
+
+func TestSimulateRejectsInvalidMutations(t *testing.T) {
+	for _, m := range []Mutation{
+		{Kind: "unknown"},
+		{Kind: RemoveReferences, SecurityGroupID: "db", RemoteSecurityGroupID: "nonexistent"},
+		{Kind: AddPorts},
+		{Kind: DeleteGroup, SecurityGroupID: "nonexistent"},
+	} {
+		_, err := Simulate(exampleProject(), []Mutation{m})
+		if err == nil {
+			t.Errorf("expected error for mutation %#v, got nil", m)
+		}
+	}
+}
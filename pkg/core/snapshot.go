@@ -0,0 +1,174 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//SnapshotVersion is the version of the snapshot file format written by this
+//version of the exporter. It must be incremented whenever the JSON
+//serialization of Project or SecurityGroup changes incompatibly.
+const SnapshotVersion = 1
+
+//Snapshot contains the data returned by CollectData() in a form that can be
+//written into a file (with WriteSnapshotFile) and scored later (with
+//ReadSnapshotFile), e.g. to reproduce a score outside of the production
+//environment.
+type Snapshot struct {
+	Version     int                 `json:"version"`
+	CollectedAt time.Time           `json:"collected_at"`
+	Projects    map[string]*Project `json:"projects"`
+}
+
+//NewSnapshot creates a snapshot for the given projects.
+func NewSnapshot(projects map[string]*Project, collectedAt time.Time) Snapshot {
+	return Snapshot{
+		Version:     SnapshotVersion,
+		CollectedAt: collectedAt.UTC(),
+		Projects:    projects,
+	}
+}
+
+//WriteSnapshotFile writes the given snapshot into a file. If the path ends in
+//".gz", the file is gzip-compressed. The path "-" refers to stdout.
+func WriteSnapshotFile(path string, snapshot Snapshot) (returnedErr error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := f.Close()
+			if returnedErr == nil {
+				returnedErr = err
+			}
+		}()
+		w = f
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		gw := gzip.NewWriter(w)
+		defer func() {
+			err := gw.Close()
+			if returnedErr == nil {
+				returnedErr = err
+			}
+		}()
+		w = gw
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snapshot)
+}
+
+//ReadSnapshotFile reads a snapshot from a file written by WriteSnapshotFile.
+//Gzip compression is detected automatically. The path "-" refers to stdin.
+func ReadSnapshotFile(path string) (*Snapshot, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+
+	var snapshot Snapshot
+	err = json.NewDecoder(r).Decode(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode snapshot from %s: %s", path, err.Error())
+	}
+	if snapshot.Version != SnapshotVersion {
+		return nil, fmt.Errorf("cannot read snapshot from %s: expected version %d, got %d", path, SnapshotVersion, snapshot.Version)
+	}
+	snapshot.normalize()
+	return &snapshot, nil
+}
+
+//Fills in missing fields in hand-written snapshots (e.g. test fixtures), so
+//that the projects behave the same as ones returned by CollectData.
+func (s *Snapshot) normalize() {
+	if s.Projects == nil {
+		s.Projects = make(map[string]*Project)
+	}
+	for projectID, project := range s.Projects {
+		if project.UUID == "" {
+			project.UUID = projectID
+		}
+		if project.Groups == nil {
+			project.Groups = make(map[string]*SecurityGroup)
+		}
+		for groupID, group := range project.Groups {
+			if group.UUID == "" {
+				group.UUID = groupID
+			}
+			if group.SharedPortCount == nil {
+				group.SharedPortCount = make(map[string]uint64)
+			}
+			if group.ReferenceCount == nil {
+				group.ReferenceCount = make(map[string]uint64)
+			}
+			if group.PortCombinations == nil {
+				//not present in snapshots from before port combinations were collected
+				group.PortCombinations = make(map[string]uint64)
+			}
+			if group.AddressGroupReferences == nil {
+				group.AddressGroupReferences = make(map[string]*AddressGroupReference)
+			}
+			//omitted from snapshots when empty
+			if group.ForeignSharedPortCount == nil {
+				group.ForeignSharedPortCount = make(map[string]uint64)
+			}
+			if group.ForeignReferenceCount == nil {
+				group.ForeignReferenceCount = make(map[string]uint64)
+			}
+			if group.ForeignPortCombinations == nil {
+				group.ForeignPortCombinations = make(map[string]uint64)
+			}
+			if group.HostPortCombinations == nil {
+				group.HostPortCombinations = make(map[string]map[string]uint64)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package history
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+)
+
+//Changes describes how the security groups and score factors of a project
+//changed between two collections.
+type Changes struct {
+	From                  time.Time         `json:"from"`
+	To                    time.Time         `json:"to"`
+	AddedSecurityGroups   []SecurityGroupID `json:"added_security_groups"`
+	RemovedSecurityGroups []SecurityGroupID `json:"removed_security_groups"`
+	FactorDeltas          []FactorDelta     `json:"factor_deltas"`
+	//Sum of all factor deltas.
+	TotalScoreDelta int64 `json:"total_score_delta"`
+}
+
+//SecurityGroupID identifies a security group in a Changes object.
+type SecurityGroupID struct {
+	UUID string `json:"id"`
+	Name string `json:"name"`
+}
+
+//FactorDelta describes how the value of a score factor changed. If the
+//factor did not exist at one of the two points in time, the respective value
+//is 0.
+type FactorDelta struct {
+	Kind                  core.FactorKind `json:"kind"`
+	SecurityGroupID       string          `json:"security_group_id,omitempty"`
+	RemoteSecurityGroupID string          `json:"remote_security_group_id,omitempty"`
+	RemoteAddressGroupID  string          `json:"remote_address_group_id,omitempty"`
+	Before                uint64          `json:"before"`
+	After                 uint64          `json:"after"`
+	Delta                 int64           `json:"delta"`
+}
+
+//Changes computes the changes in the given project between the two given
+//points in time, using the most recent details record not newer than each
+//point in time. Returns nil if there is no details record for `to`.
+func (s *Store) Changes(projectID string, from, to time.Time) (*Changes, error) {
+	before, err := s.Details(projectID, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.Details(projectID, to)
+	if err != nil {
+		return nil, err
+	}
+	if after == nil {
+		return nil, nil
+	}
+	if before == nil {
+		//project did not exist yet at `from`
+		before = &DetailsRecord{Time: from.UTC()}
+	}
+	return CompareDetails(*before, *after), nil
+}
+
+//CompareDetails computes the changes between two details records.
+func CompareDetails(before, after DetailsRecord) *Changes {
+	result := &Changes{
+		From:                  before.Time,
+		To:                    after.Time,
+		AddedSecurityGroups:   []SecurityGroupID{},
+		RemovedSecurityGroups: []SecurityGroupID{},
+		FactorDeltas:          []FactorDelta{},
+	}
+
+	for groupID, name := range after.SecurityGroups {
+		if _, exists := before.SecurityGroups[groupID]; !exists {
+			result.AddedSecurityGroups = append(result.AddedSecurityGroups, SecurityGroupID{groupID, name})
+		}
+	}
+	for groupID, name := range before.SecurityGroups {
+		if _, exists := after.SecurityGroups[groupID]; !exists {
+			result.RemovedSecurityGroups = append(result.RemovedSecurityGroups, SecurityGroupID{groupID, name})
+		}
+	}
+	sortSecurityGroupIDs(result.AddedSecurityGroups)
+	sortSecurityGroupIDs(result.RemovedSecurityGroups)
+
+	type factorKey struct {
+		Kind                  core.FactorKind
+		SecurityGroupID       string
+		RemoteSecurityGroupID string
+		RemoteAddressGroupID  string
+	}
+	deltas := make(map[factorKey]*FactorDelta)
+	getDelta := func(f FactorRecord) *FactorDelta {
+		key := factorKey{f.Kind, f.SecurityGroupID, f.RemoteSecurityGroupID, f.RemoteAddressGroupID}
+		delta, exists := deltas[key]
+		if !exists {
+			delta = &FactorDelta{
+				Kind:                  f.Kind,
+				SecurityGroupID:       f.SecurityGroupID,
+				RemoteSecurityGroupID: f.RemoteSecurityGroupID,
+				RemoteAddressGroupID:  f.RemoteAddressGroupID,
+			}
+			deltas[key] = delta
+		}
+		return delta
+	}
+	for _, f := range before.Factors {
+		getDelta(f).Before += f.Value
+	}
+	for _, f := range after.Factors {
+		getDelta(f).After += f.Value
+	}
+
+	for _, delta := range deltas {
+		if delta.Before == delta.After {
+			continue
+		}
+		delta.Delta = int64(delta.After) - int64(delta.Before)
+		result.TotalScoreDelta += delta.Delta
+		result.FactorDeltas = append(result.FactorDeltas, *delta)
+	}
+	sort.Slice(result.FactorDeltas, func(i, j int) bool {
+		di, dj := abs(result.FactorDeltas[i].Delta), abs(result.FactorDeltas[j].Delta)
+		if di != dj {
+			return di > dj
+		}
+		return factorDeltaLess(result.FactorDeltas[i], result.FactorDeltas[j])
+	})
+
+	return result
+}
+
+func sortSecurityGroupIDs(ids []SecurityGroupID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].UUID < ids[j].UUID
+	})
+}
+
+func sortFactorRecords(factors []FactorRecord) {
+	sort.Slice(factors, func(i, j int) bool {
+		fi, fj := factors[i], factors[j]
+		if fi.Kind != fj.Kind {
+			return fi.Kind < fj.Kind
+		}
+		if fi.SecurityGroupID != fj.SecurityGroupID {
+			return fi.SecurityGroupID < fj.SecurityGroupID
+		}
+		if fi.RemoteSecurityGroupID != fj.RemoteSecurityGroupID {
+			return fi.RemoteSecurityGroupID < fj.RemoteSecurityGroupID
+		}
+		return fi.RemoteAddressGroupID < fj.RemoteAddressGroupID
+	})
+}
+
+func factorDeltaLess(a, b FactorDelta) bool {
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.SecurityGroupID != b.SecurityGroupID {
+		return a.SecurityGroupID < b.SecurityGroupID
+	}
+	if a.RemoteSecurityGroupID != b.RemoteSecurityGroupID {
+		return a.RemoteSecurityGroupID < b.RemoteSecurityGroupID
+	}
+	return a.RemoteAddressGroupID < b.RemoteAddressGroupID
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,332 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package history records entanglement scores over a long period of time, so
+//that questions like "when did our entanglement explode?" can be answered
+//after the Prometheus retention period has passed.
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+)
+
+//The database file contains two top-level buckets, each containing one
+//bucket per project. Within a project bucket, records are keyed by the
+//collection time (as big-endian UNIX timestamp, so that keys sort
+//chronologically).
+//
+//- The scores bucket contains a ScoreRecord for each collection.
+//- The details bucket contains a DetailsRecord for each collection where the
+//  details have changed since the previous collection. (Since most projects
+//  do not change most of the time, this saves a lot of space.)
+var (
+	scoresBucketName  = []byte("scores")
+	detailsBucketName = []byte("details")
+)
+
+//ScoreRecord contains the scores of a project from a single collection.
+type ScoreRecord struct {
+	Time              time.Time                  `json:"time"`
+	ScoringModel      string                     `json:"scoring_model"`
+	MaxScore          uint64                     `json:"max_score"`
+	TotalScore        uint64                     `json:"total_score"`
+	ScoreByFactorKind map[core.FactorKind]uint64 `json:"score_by_factor"`
+	//Only partitions with non-zero score are included (key = partition ID).
+	PartitionScores map[string]uint64 `json:"partition_scores"`
+}
+
+//DetailsRecord contains the security groups and score factors of a project
+//from a single collection.
+type DetailsRecord struct {
+	Time time.Time `json:"time"`
+	//key = UUID, value = name
+	SecurityGroups map[string]string `json:"security_groups"`
+	Factors        []FactorRecord    `json:"factors"`
+}
+
+//FactorRecord is a core.Factor without its Reason (which can be reconstructed
+//from the other fields, and takes up a lot of space).
+type FactorRecord struct {
+	Kind                  core.FactorKind `json:"kind"`
+	Value                 uint64          `json:"value"`
+	SecurityGroupID       string          `json:"security_group_id,omitempty"`
+	RemoteSecurityGroupID string          `json:"remote_security_group_id,omitempty"`
+	RemoteAddressGroupID  string          `json:"remote_address_group_id,omitempty"`
+}
+
+//Store is a history database backed by a bolt file.
+type Store struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+//Open opens the history database at the given path, or creates it if it does
+//not exist. Records older than the given retention period are removed
+//whenever new records are added.
+func Open(path string, retention time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scoresBucketName, detailsBucketName} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db, retention}, nil
+}
+
+//Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+//Record adds records for all projects in the given report.
+func (s *Store) Record(report *core.Report) error {
+	key := timeToKey(report.CollectedAt)
+	cutoff := timeToKey(report.CollectedAt.Add(-s.retention))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		scoresBucket := tx.Bucket(scoresBucketName)
+		detailsBucket := tx.Bucket(detailsBucketName)
+
+		for projectID, pr := range report.Projects {
+			scores, err := scoresBucket.CreateBucketIfNotExists([]byte(projectID))
+			if err != nil {
+				return err
+			}
+			err = putJSON(scores, key, newScoreRecord(report, pr))
+			if err != nil {
+				return err
+			}
+
+			details, err := detailsBucket.CreateBucketIfNotExists([]byte(projectID))
+			if err != nil {
+				return err
+			}
+			err = putDetailsIfChanged(details, key, newDetailsRecord(report.CollectedAt, pr))
+			if err != nil {
+				return err
+			}
+		}
+
+		//enforce retention period
+		err := pruneProjectBuckets(scoresBucket, cutoff, func([]byte) bool { return false })
+		if err != nil {
+			return err
+		}
+		//Details records are only written when they change, so the newest
+		//expired details record is still the current one for all times until
+		//the next details record. It is kept as long as the project still has
+		//score records, i.e. as long as it still exists.
+		return pruneProjectBuckets(detailsBucket, cutoff, func(projectID []byte) bool {
+			return scoresBucket.Bucket(projectID) != nil
+		})
+	})
+}
+
+//ScoreHistory returns all score records of the given project in the given
+//time range (inclusive).
+func (s *Store) ScoreHistory(projectID string, from, to time.Time) ([]ScoreRecord, error) {
+	result := []ScoreRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scoresBucketName).Bucket([]byte(projectID))
+		if bucket == nil {
+			return nil
+		}
+		toKey := timeToKey(to)
+		c := bucket.Cursor()
+		for k, v := c.Seek(timeToKey(from)); k != nil && bytes.Compare(k, toKey) <= 0; k, v = c.Next() {
+			var record ScoreRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return err
+			}
+			result = append(result, record)
+		}
+		return nil
+	})
+	return result, err
+}
+
+//Details returns the most recent details record of the given project that
+//is not newer than the given time, or nil if there is none.
+func (s *Store) Details(projectID string, at time.Time) (*DetailsRecord, error) {
+	var result *DetailsRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(detailsBucketName).Bucket([]byte(projectID))
+		if bucket == nil {
+			return nil
+		}
+
+		atKey := timeToKey(at)
+		c := bucket.Cursor()
+		k, v := c.Seek(atKey)
+		if k == nil || !bytes.Equal(k, atKey) {
+			//Seek() went to the first record after `at`, so go back one record
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return nil
+		}
+
+		result = &DetailsRecord{}
+		return json.Unmarshal(v, result)
+	})
+	return result, err
+}
+
+func newScoreRecord(report *core.Report, pr *core.ProjectReport) ScoreRecord {
+	record := ScoreRecord{
+		Time:              report.CollectedAt.UTC(),
+		ScoringModel:      report.ScoringModel,
+		MaxScore:          pr.MaxScore,
+		TotalScore:        pr.TotalScore,
+		ScoreByFactorKind: pr.TotalScoreByFactorKind,
+		PartitionScores:   make(map[string]uint64),
+	}
+	for _, part := range pr.Partitions {
+		if part.Score.Value > 0 {
+			record.PartitionScores[part.Partition.ID()] = part.Score.Value
+		}
+	}
+	return record
+}
+
+func newDetailsRecord(collectedAt time.Time, pr *core.ProjectReport) DetailsRecord {
+	record := DetailsRecord{
+		Time:           collectedAt.UTC(),
+		SecurityGroups: make(map[string]string, len(pr.Project.Groups)),
+		Factors:        []FactorRecord{},
+	}
+	for groupID, group := range pr.Project.Groups {
+		record.SecurityGroups[groupID] = group.Name
+	}
+	for _, part := range pr.Partitions {
+		for _, factor := range part.Score.Factors {
+			record.Factors = append(record.Factors, FactorRecord{
+				Kind:                  factor.Kind,
+				Value:                 factor.Value,
+				SecurityGroupID:       factor.SecurityGroupID,
+				RemoteSecurityGroupID: factor.RemoteSecurityGroupID,
+				RemoteAddressGroupID:  factor.RemoteAddressGroupID,
+			})
+		}
+	}
+	sortFactorRecords(record.Factors)
+	return record
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, buf)
+}
+
+func putDetailsIfChanged(bucket *bolt.Bucket, key []byte, record DetailsRecord) error {
+	_, lastBuf := bucket.Cursor().Last()
+	if lastBuf != nil {
+		var last DetailsRecord
+		err := json.Unmarshal(lastBuf, &last)
+		if err != nil {
+			return err
+		}
+		last.Time = record.Time
+		if detailsEqual(last, record) {
+			return nil
+		}
+	}
+	return putJSON(bucket, key, record)
+}
+
+func detailsEqual(a, b DetailsRecord) bool {
+	bufA, errA := json.Marshal(a)
+	bufB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(bufA, bufB)
+}
+
+//Removes all records older than the cutoff from all project buckets in the
+//given top-level bucket, and removes project buckets that become empty. If
+//keepNewest returns true for a project, its newest record older than the
+//cutoff is not removed.
+func pruneProjectBuckets(parent *bolt.Bucket, cutoff []byte, keepNewest func(projectID []byte) bool) error {
+	var emptyBuckets [][]byte
+	err := parent.ForEach(func(projectID, _ []byte) error {
+		bucket := parent.Bucket(projectID)
+
+		//collect keys first since Cursor.Next() skips a key after Cursor.Delete()
+		var expiredKeys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+			expiredKeys = append(expiredKeys, append([]byte(nil), k...))
+		}
+		if len(expiredKeys) > 0 && keepNewest(projectID) {
+			expiredKeys = expiredKeys[:len(expiredKeys)-1]
+		}
+		for _, k := range expiredKeys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		if k, _ := bucket.Cursor().First(); k == nil {
+			emptyBuckets = append(emptyBuckets, append([]byte(nil), projectID...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, projectID := range emptyBuckets {
+		err := parent.DeleteBucket(projectID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timeToKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	unix := t.Unix()
+	if unix < 0 {
+		unix = 0
+	}
+	binary.BigEndian.PutUint64(key, uint64(unix))
+	return key
+}
@@ -0,0 +1,135 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/secgroup-entanglement-exporter/pkg/core"
+)
+
+func openTestStore(t *testing.T, retention time.Duration) *Store {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := Open(filepath.Join(dir, "history.db"), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+//Records a report where each of the given projects contains a single group
+//with the given name.
+func recordAt(t *testing.T, s *Store, unix int64, groupNameByProjectID map[string]string) {
+	t.Helper()
+	projects := make(map[string]*core.Project)
+	for projectID, groupName := range groupNameByProjectID {
+		projects[projectID] = &core.Project{
+			UUID: projectID,
+			Groups: map[string]*core.SecurityGroup{
+				projectID + "-group": {UUID: projectID + "-group", Name: groupName, PortCount: 1},
+			},
+		}
+	}
+	err := s.Record(core.NewReport(projects, time.Unix(unix, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneRemovesAllExpiredRecords(t *testing.T) {
+	s := openTestStore(t, 50*time.Second)
+	for unix := int64(1000); unix <= 1005; unix++ {
+		//change the details every time, so that each collection gets a details record
+		recordAt(t, s, unix, map[string]string{"p": time.Unix(unix, 0).String()})
+	}
+	recordAt(t, s, 1100, map[string]string{"p": "latest"})
+
+	scores, err := s.ScoreHistory("p", time.Unix(0, 0), time.Unix(2000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 1 || scores[0].Time.Unix() != 1100 {
+		t.Errorf("expected only the score record at 1100, got %#v", scores)
+	}
+
+	//only the newest expired details record is kept, since it was current until 1100
+	for unix := int64(1000); unix <= 1004; unix++ {
+		details, err := s.Details("p", time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details != nil {
+			t.Errorf("expected details record at %d to be pruned, got %#v", unix, details)
+		}
+	}
+	details, err := s.Details("p", time.Unix(1050, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details == nil || details.Time.Unix() != 1005 {
+		t.Errorf("expected details record at 1005 to be kept, got %#v", details)
+	}
+}
+
+func TestPruneKeepsUnchangedDetails(t *testing.T) {
+	s := openTestStore(t, 50*time.Second)
+	for _, unix := range []int64{1000, 1040, 1080, 1120, 1160} {
+		recordAt(t, s, unix, map[string]string{"p": "unchanged"})
+
+		details, err := s.Details("p", time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details == nil || details.Time.Unix() != 1000 {
+			t.Errorf("at %d: expected details record from 1000, got %#v", unix, details)
+		}
+	}
+}
+
+func TestPruneRemovesDeletedProjects(t *testing.T) {
+	s := openTestStore(t, 50*time.Second)
+	recordAt(t, s, 1000, map[string]string{"p": "foo", "deleted": "bar"})
+	recordAt(t, s, 1100, map[string]string{"p": "foo"})
+
+	details, err := s.Details("deleted", time.Unix(1100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details != nil {
+		t.Errorf("expected details of deleted project to be pruned, got %#v", details)
+	}
+	details, err = s.Details("p", time.Unix(1100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details == nil {
+		t.Error("expected details of existing project to be kept")
+	}
+}